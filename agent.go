@@ -0,0 +1,1069 @@
+package tumblream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultPageLimit = 20
+	// MaxPageLimit is max number of posts per request allowed by api.
+	MaxPageLimit = 50
+)
+
+// DefaultBaseURL is url of tumblr api.
+const DefaultBaseURL = "https://api.tumblr.com"
+
+type Agent struct {
+	// lastId is id of newest processed post, or its liked timestamp for likes.
+	// it is read by others while Run updates it.
+	lastId   atomic.Int64
+	Hostname string
+	ApiKey   string
+	Size     string
+	// Sizes is sizes of photo to save. each size is queued as separate item
+	// and Size is ignored when it is set.
+	Sizes []string
+	Types []string
+	Tags  []string
+	// Timeout limits time of an api request including reading response. 0
+	// means unlimited.
+	Timeout time.Duration
+	// BaseURL is url of tumblr api. DefaultBaseURL is used when it is empty.
+	BaseURL string
+	// Client is used to access api. zero Client is used when it is nil.
+	Client *Client
+	// Source is posts or likes.
+	Source string
+	// States is states of posts fetched from published, queue and draft.
+	// queue and draft require OAuth. empty means published only.
+	States []string
+	// Reblogs is one of all, exclude and only.
+	Reblogs string
+	// MinWidth and MinHeight skip photos whose largest size is smaller than
+	// them. 0 means unlimited.
+	MinWidth  int
+	MinHeight int
+	// Extensions limits extensions of saved files like "jpg". empty means
+	// all.
+	Extensions []string
+	// NewerThan stops paging at posts older than it. zero means unlimited.
+	NewerThan time.Time
+	// Budget stops queueing posts when bytes saved in cycle reach it.
+	Budget *ByteBudget
+	// LowSpace reports whether storage is nearly full. posts are not queued
+	// while it is true. nil means never.
+	LowSpace func() bool
+	// OnEvent is called with EventPostDiscovered for each new post.
+	OnEvent func(Event)
+	// PageLimit is number of posts fetched by a request. 0 means
+	// DefaultPageLimit.
+	PageLimit int
+	// AfterId and BeforeId limit posts to ones whose id is in between them
+	// exclusively. paging stops at AfterId. 0 means unlimited.
+	AfterId  int64
+	BeforeId int64
+	// FetchAll pages to oldest post even when last id is 0.
+	FetchAll bool
+	// Prefetch fetches next page while posts of current page are queued.
+	Prefetch bool
+	// MaxPosts limits number of posts processed in a Run. 0 means unlimited.
+	MaxPosts int
+	// Breaker skips cycles of blog which keeps failing. nil never skips.
+	Breaker *Breaker
+
+	// Downloaded is urls which are already saved. they are not queued.
+	Downloaded *URLStore
+	// Dead is urls which are removed from server. they are not queued.
+	Dead *DeadURLStore
+	// Skip reports whether item is already saved. items are queued when it
+	// is nil.
+	Skip func(item Item) bool
+
+	// stats is counters of current cycle.
+	stats *Stats
+	// queued is urls queued in current cycle. same image may appear in many
+	// posts.
+	queued map[string]bool
+	// backlog is cursors of paths whose paging stopped at MaxPosts, Budget or
+	// LowSpace before last id. next Run resumes paging from them.
+	backlog map[string]*cursor
+}
+
+// cursor is position of paging of a path.
+type cursor struct {
+	// top is position of newest post of path when paging started.
+	top      int64
+	before   int64
+	oldestId int64
+	// seen is ids of posts at oldestId.
+	seen map[int64]bool
+	// done reports whether path is paged to last id.
+	done bool
+}
+
+// Reset starts new cycle of agent. counters of previous cycle are cleared,
+// but lastId is kept so that posts made during failures are not lost.
+func (a *Agent) Reset() {
+	a.stats = &Stats{}
+	a.queued = nil
+}
+
+// LastId returns id of newest processed post.
+func (a *Agent) LastId() int64 {
+	return a.lastId.Load()
+}
+
+// SetLastId sets id of newest processed post. posts before it are not
+// processed by Run. 0 means that Run only records newest post.
+func (a *Agent) SetLastId(lastId int64) {
+	a.lastId.Store(lastId)
+}
+
+// Stats returns counters of current cycle.
+func (a *Agent) Stats() *Stats {
+	return a.stats
+}
+
+func (a *Agent) client() *Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return &Client{}
+}
+
+func (a *Agent) Log(v ...interface{}) {
+	logger.Log(LevelInfo, "agent", a.Hostname, fmt.Sprint(v...))
+}
+
+func (a *Agent) Debug(v ...interface{}) {
+	logger.Log(LevelDebug, "agent", a.Hostname, fmt.Sprint(v...))
+}
+
+func (a *Agent) Warn(v ...interface{}) {
+	logger.Log(LevelWarn, "agent", a.Hostname, fmt.Sprint(v...))
+}
+
+func (a *Agent) Error(v ...interface{}) {
+	logger.Log(LevelError, "agent", a.Hostname, fmt.Sprint(v...))
+}
+
+func (a *Agent) Run(ctx context.Context, q chan<- Item) error {
+	a.Log("run")
+	defer func() {
+		a.Log("finished")
+	}()
+
+	if a.stats == nil {
+		a.stats = &Stats{}
+	}
+
+	// paging stops at MaxPosts, Budget or LowSpace, and rest of posts are
+	// paged from cursors in backlog next cycle.
+	var handled int
+	var stopped bool
+	stop := func() bool {
+		if stopped {
+			return true
+		}
+		switch {
+		case a.MaxPosts > 0 && handled >= a.MaxPosts:
+			a.Log("reached max posts ", a.MaxPosts, ". rest of posts are left for next cycle")
+		case a.Budget.Exceeded():
+			a.Log("reached max bytes ", a.Budget.Max, ". rest of posts are left for next cycle")
+		case a.LowSpace != nil && a.LowSpace():
+			a.Warn("storage is nearly full. rest of posts are left for next cycle")
+		default:
+			return false
+		}
+		stopped = true
+		return true
+	}
+	handle := func(post *TumblrResponsePost) error {
+		handled++
+		return a.queuePost(ctx, q, post)
+	}
+
+	// post id is unique across types in a blog, so newest one of all types
+	// becomes last id. likes are fetched at once and filtered by types in
+	// run.
+	paths := []string{"likes"}
+	if a.Source != SourceLikes {
+		paths = nil
+		if a.hasState(StatePublished) {
+			for _, typ := range a.Types {
+				paths = append(paths, "posts/"+typ)
+				if typ == "photo" {
+					paths = append(paths, npfPath)
+				}
+			}
+		}
+	}
+	resumed := a.backlog != nil
+	cursors := a.backlog
+	if cursors == nil {
+		cursors = map[string]*cursor{}
+	}
+	for _, path := range paths {
+		c := cursors[path]
+		if c == nil {
+			c = &cursor{}
+			cursors[path] = c
+		}
+		if c.done || stop() {
+			continue
+		}
+		if err := a.run(ctx, path, c, stop, handle); err != nil {
+			return err
+		}
+	}
+
+	// last id is not moved until all paths are paged to it. after backlog,
+	// it becomes oldest top of paths, so that posts made in a path while
+	// others were paged are not lost. newer posts of others are paged again.
+	a.backlog = nil
+	var lastId int64
+	for _, c := range cursors {
+		if !c.done {
+			a.backlog = cursors
+			lastId = 0
+			break
+		}
+		if c.top != 0 && (lastId == 0 || resumed && c.top < lastId || !resumed && c.top > lastId) {
+			lastId = c.top
+		}
+	}
+
+	if a.Source != SourceLikes {
+		for _, state := range []string{StateQueue, StateDraft} {
+			if !a.hasState(state) {
+				continue
+			}
+			if err := a.runState(ctx, q, state); err != nil {
+				return err
+			}
+		}
+	}
+
+	if lastId != 0 && a.lastId.Load() != lastId {
+		a.Log("update last id ", a.lastId.Load(), " to ", lastId)
+		a.lastId.Store(lastId)
+	}
+	metrics.SetLastId(a.Hostname, a.lastId.Load())
+
+	return nil
+}
+
+// position returns position of post in paging. it is post id, or liked
+// timestamp for likes because liked posts are ordered by it.
+func (a *Agent) position(post *TumblrResponsePost) int64 {
+	if a.Source == SourceLikes {
+		return post.LikedTimestamp
+	}
+	return post.Id
+}
+
+// postTime returns time of post in paging, which is liked time for likes.
+func (a *Agent) postTime(post *TumblrResponsePost) time.Time {
+	if a.Source == SourceLikes {
+		return time.Unix(post.LikedTimestamp, 0)
+	}
+	return time.Unix(post.Timestamp, 0)
+}
+
+// before returns before parameter of page next to post. it includes the
+// second of post, so that other posts in same second are not lost.
+func (a *Agent) before(post *TumblrResponsePost) int64 {
+	if a.Source == SourceLikes {
+		return post.LikedTimestamp + 1
+	}
+	return post.Timestamp + 1
+}
+
+// paged reports whether post at pos is already paged. pages overlap at
+// oldestId, and posts liked in same second share it as position, so posts
+// there are told apart by ids in seen.
+func paged(post *TumblrResponsePost, pos int64, oldestId int64, seen map[int64]bool) bool {
+	return oldestId != 0 && (pos > oldestId || pos == oldestId && seen[post.Id])
+}
+
+// nextBefore returns before parameter of page next to posts. it returns false
+// when paging will stop in posts, so that page over last id is not fetched.
+func (a *Agent) nextBefore(posts []TumblrResponsePost, oldestId int64, seen map[int64]bool) (int64, bool) {
+	last := &posts[len(posts)-1]
+	pos := a.position(last)
+	if paged(last, pos, oldestId, seen) {
+		return 0, false
+	}
+	if a.lastId.Load() >= pos {
+		return 0, false
+	}
+	if !a.NewerThan.IsZero() && a.postTime(last).Before(a.NewerThan) {
+		return 0, false
+	}
+	return a.before(last), true
+}
+
+type fetchResult struct {
+	resp *TumblrResponse
+	err  error
+}
+
+// prefetch fetches page in background.
+func (a *Agent) prefetch(ctx context.Context, path string, limit int, before int64) <-chan fetchResult {
+	ch := make(chan fetchResult, 1)
+	go func() {
+		resp, err := a.Fetch(ctx, path, limit, before)
+		ch <- fetchResult{resp: resp, err: err}
+	}()
+	return ch
+}
+
+// run paginates posts of path from c until last id, and calls handle with
+// each new post. it pages backwards by timestamp, because api does not allow
+// large offset. c is left at post where stop returns true, and done is set
+// when paging reaches end.
+func (a *Agent) run(ctx context.Context, path string, c *cursor, stop func() bool, handle func(*TumblrResponsePost) error) error {
+	limit := a.pageLimit()
+	var fetched int64
+
+	// next is page fetched while posts of current page are handled.
+	var next <-chan fetchResult
+	prefetchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+OUTER:
+	for {
+		var resp *TumblrResponse
+		var err error
+		if next != nil {
+			r := <-next
+			resp, err = r.resp, r.err
+			next = nil
+		} else {
+			resp, err = a.Fetch(ctx, path, limit, c.before)
+		}
+		if err != nil {
+			return err
+		}
+
+		posts := resp.Posts()
+		if len(posts) < 1 {
+			a.Log("not posts")
+			break
+		}
+
+		if c.top == 0 {
+			c.top = a.position(&posts[0])
+		}
+
+		// only set last id first time. with NewerThan or FetchAll, posts are
+		// fetched even in first time.
+		if a.lastId.Load() == 0 && a.NewerThan.IsZero() && !a.FetchAll {
+			break
+		}
+
+		if a.Prefetch {
+			if b, ok := a.nextBefore(posts, c.oldestId, c.seen); ok {
+				next = a.prefetch(prefetchCtx, path, limit, b)
+			}
+		}
+
+		progressed := false
+		for _, post := range posts {
+			pos := a.position(&post)
+			// posts published in same second as oldest one of previous page
+			// are fetched again. skip them.
+			if paged(&post, pos, c.oldestId, c.seen) {
+				continue
+			}
+			progressed = true
+			fetched++
+
+			if a.lastId.Load() == pos {
+				a.logProgress(path, fetched, resp.Total())
+				break OUTER
+			}
+
+			if a.lastId.Load() > pos {
+				a.Warn("seems to over last id", a.lastId.Load(), " > ", pos)
+				a.logProgress(path, fetched, resp.Total())
+				break OUTER
+			}
+
+			// window of ids is for posts, whose ids are newest first.
+			if a.AfterId > 0 && post.Id <= a.AfterId {
+				a.Log("reached after id ", a.AfterId)
+				a.logProgress(path, fetched, resp.Total())
+				break OUTER
+			}
+
+			// posts are newest first, so rest of them are older too.
+			if !a.NewerThan.IsZero() && a.postTime(&post).Before(a.NewerThan) {
+				a.Log("reached posts older than ", a.NewerThan.Format(time.RFC3339))
+				a.logProgress(path, fetched, resp.Total())
+				break OUTER
+			}
+
+			// c is left before post, so that it is paged next cycle.
+			if stop() {
+				a.logProgress(path, fetched, resp.Total())
+				return nil
+			}
+			if pos != c.oldestId {
+				c.oldestId = pos
+				c.seen = map[int64]bool{}
+			}
+			c.seen[post.Id] = true
+			c.before = a.before(&post)
+
+			if a.BeforeId > 0 && post.Id >= a.BeforeId {
+				continue
+			}
+
+			// text posts are fetched only for images of posts made in NPF.
+			if path == npfPath && len(post.Images()) == 0 {
+				continue
+			}
+			if a.Source == SourceLikes && !a.matchType(&post) {
+				continue
+			}
+
+			a.stats.Posts.Add(1)
+			metrics.PostsFetched.Add(1)
+			if a.OnEvent != nil {
+				a.OnEvent(Event{Type: EventPostDiscovered, Time: time.Now(), Blog: a.Hostname, PostId: post.Id, PostUrl: post.PostUrl})
+			}
+
+			if err := handle(&post); err != nil {
+				return err
+			}
+		}
+
+		a.logProgress(path, fetched, resp.Total())
+
+		if !progressed {
+			// short page of paged posts is end of posts.
+			if len(posts) >= limit {
+				a.Log("too many posts in same timestamp ", c.before-1, ". so stop paging")
+			}
+			break
+		}
+	}
+
+	c.done = true
+	return nil
+}
+
+func (a *Agent) pageLimit() int {
+	if a.PageLimit <= 0 {
+		return DefaultPageLimit
+	}
+	return a.PageLimit
+}
+
+// hasState reports whether posts of state are fetched.
+func (a *Agent) hasState(state string) bool {
+	if len(a.States) == 0 {
+		return state == StatePublished
+	}
+	for _, s := range a.States {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// maxStatePageLimit is max limit of queue api.
+const maxStatePageLimit = 20
+
+// runState queues all posts of state, which is queue or draft. they are not
+// published yet, so they are fetched every cycle regardless of last id.
+// queued posts are paged by offset and drafts by before_id.
+func (a *Agent) runState(ctx context.Context, q chan<- Item, state string) error {
+	limit := a.pageLimit()
+	if limit > maxStatePageLimit {
+		limit = maxStatePageLimit
+	}
+	path := "posts/" + state
+	var offset int
+	var beforeId int64
+	var fetched int64
+
+	for {
+		v := url.Values{}
+		v.Set("limit", strconv.Itoa(limit))
+		switch state {
+		case StateQueue:
+			v.Set("offset", strconv.Itoa(offset))
+		case StateDraft:
+			if beforeId != 0 {
+				v.Set("before_id", strconv.FormatInt(beforeId, 10))
+			}
+		}
+
+		resp, err := a.fetch(ctx, path, v)
+		if err != nil {
+			return err
+		}
+
+		posts := resp.Posts()
+		progressed := false
+		for i := range posts {
+			post := &posts[i]
+			// drafts are newest first, but queued posts are in order of
+			// publishing, so ids of them are ascending.
+			if state == StateDraft {
+				if beforeId != 0 && post.Id >= beforeId {
+					continue
+				}
+				beforeId = post.Id
+			}
+			progressed = true
+			fetched++
+			if !a.matchType(post) {
+				continue
+			}
+			a.stats.Posts.Add(1)
+			metrics.PostsFetched.Add(1)
+			if err := a.queuePost(ctx, q, post); err != nil {
+				return err
+			}
+		}
+		a.logProgress(path, fetched, resp.Total())
+
+		if !progressed || len(posts) < limit {
+			return nil
+		}
+		offset += len(posts)
+	}
+}
+
+// matchType reports whether type of post is in Types.
+func (a *Agent) matchType(post *TumblrResponsePost) bool {
+	for _, typ := range a.Types {
+		if post.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Agent) logProgress(path string, fetched int64, total int64) {
+	a.Log("fetched ", fetched, "/", total, " posts of ", path)
+}
+
+// queuePost queues media of post which are not downloaded yet.
+func (a *Agent) queuePost(ctx context.Context, q chan<- Item, post *TumblrResponsePost) error {
+	if !a.matchTags(post) || !a.matchReblogs(post) {
+		return nil
+	}
+
+	for _, media := range a.mediaUrls(post) {
+		url := media.Url
+		item := Item{
+			Hostname:  a.Hostname,
+			Url:       url,
+			Index:     media.Index,
+			Size:      media.Size,
+			PostId:    post.Id,
+			PostUrl:   post.PostUrl,
+			Timestamp: post.Timestamp,
+			Stats:     a.stats,
+		}
+		if !a.matchExt(url) {
+			a.Debug("extension of ", url, " is not allowed. so skip it.")
+			continue
+		}
+		// same media may have different urls. saver also names files by
+		// normalized url. urls saved by older versions are not normalized.
+		url = NormalizeURL(url)
+		if a.Downloaded != nil && (a.Downloaded.Has(url) || a.Downloaded.Has(item.Url)) {
+			a.stats.Skipped.Add(1)
+			continue
+		}
+		if a.Dead != nil && a.Dead.Has(url) {
+			a.Debug(url, " is dead. so skip it.")
+			a.stats.Skipped.Add(1)
+			continue
+		}
+		if a.Skip != nil && a.Skip(item) {
+			a.Debug(url, " is already saved. so skip it.")
+			a.stats.Skipped.Add(1)
+			continue
+		}
+		if a.queued[url] {
+			a.Debug(url, " is already queued in this cycle. so skip it.")
+			continue
+		}
+		select {
+		case q <- item:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		a.stats.Queued.Add(1)
+		if a.queued == nil {
+			a.queued = map[string]bool{}
+		}
+		a.queued[url] = true
+	}
+
+	return nil
+}
+
+// matchExt reports whether extension of url is in Extensions.
+func (a *Agent) matchExt(url string) bool {
+	if len(a.Extensions) == 0 {
+		return true
+	}
+	ext := urlExt(url)
+	for _, e := range a.Extensions {
+		if strings.EqualFold(strings.TrimPrefix(e, "."), ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchReblogs reports whether post is wanted by Reblogs mode.
+func (a *Agent) matchReblogs(post *TumblrResponsePost) bool {
+	switch a.Reblogs {
+	case ReblogsExclude:
+		return !post.IsReblog()
+	case ReblogsOnly:
+		return post.IsReblog()
+	}
+	return true
+}
+
+// matchTags reports whether post has any of Tags. when Tags is empty, every
+// post matches.
+func (a *Agent) matchTags(post *TumblrResponsePost) bool {
+	if len(a.Tags) == 0 {
+		return true
+	}
+	for _, tag := range post.Tags {
+		for _, t := range a.Tags {
+			if strings.EqualFold(tag, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDimensions reports whether largest size of photo is at least MinWidth
+// and MinHeight.
+func (a *Agent) matchDimensions(post *TumblrResponsePost, photo *TumblrResponsePhoto) bool {
+	if a.MinWidth <= 0 && a.MinHeight <= 0 {
+		return true
+	}
+	largest, ok := photo.SelectSize("largest")
+	if !ok {
+		// it is warned as photo without usable sizes.
+		return true
+	}
+	width, height := largest.Width, largest.Height
+	if o := photo.OriginalSize; o != nil && o.Url != "" && o.Width*o.Height > width*height {
+		width, height = o.Width, o.Height
+	}
+	if width < float64(a.MinWidth) || height < float64(a.MinHeight) {
+		a.Debug("photo of post ", post.Id, " is ", width, "x", height, ". so skip it.")
+		return false
+	}
+	return true
+}
+
+// mediaUrl is url of media in post. Size is set when it is one of Sizes.
+type mediaUrl struct {
+	Url   string
+	Index int
+	Size  string
+}
+
+func (a *Agent) mediaUrls(post *TumblrResponsePost) []mediaUrl {
+	urls := []mediaUrl{}
+
+	index := 0
+	for _, photo := range post.Images() {
+		if !a.matchDimensions(post, &photo) {
+			continue
+		}
+		if len(a.Sizes) == 0 {
+			photoSize, ok := photo.SelectSize(a.Size)
+			if !ok {
+				a.Warn("post ", post.Id, " has photo without usable sizes. so skip it.")
+				continue
+			}
+			urls = append(urls, mediaUrl{Url: photoSize.Url, Index: index})
+			index++
+			continue
+		}
+
+		// sizes resolved to same url (e.g. smaller photo than requested
+		// width) are saved once by first size.
+		seen := map[string]bool{}
+		for _, size := range a.Sizes {
+			photoSize, ok := photo.SelectSize(size)
+			if !ok || seen[photoSize.Url] {
+				continue
+			}
+			seen[photoSize.Url] = true
+			urls = append(urls, mediaUrl{Url: photoSize.Url, Index: index, Size: size})
+		}
+		if len(seen) == 0 {
+			a.Warn("post ", post.Id, " has photo without usable sizes. so skip it.")
+			continue
+		}
+		index++
+	}
+
+	if post.VideoUrl != "" {
+		urls = append(urls, mediaUrl{Url: post.VideoUrl, Index: index})
+	}
+
+	return urls
+}
+
+// npfPath is path of posts made in NPF. legacy api reports them as text
+// posts without their media, so they are fetched in NPF to read image blocks.
+const npfPath = "posts/text"
+
+// Fetch fetches posts from path of blog (e.g. "posts/photo" or "likes")
+// published or liked before the unix timestamp. when before is 0, newest
+// posts are fetched.
+func (a *Agent) Fetch(ctx context.Context, path string, limit int, before int64) (*TumblrResponse, error) {
+	v := url.Values{}
+	v.Set("limit", strconv.Itoa(limit))
+	if path == npfPath {
+		v.Set("npf", "true")
+	}
+	if before != 0 {
+		v.Set("before", strconv.FormatInt(before, 10))
+	}
+	return a.fetch(ctx, path, v)
+}
+
+// fetch fetches path of blog with query v. api key is added to v. error is
+// returned as *FetchError.
+func (a *Agent) fetch(ctx context.Context, path string, v url.Values) (*TumblrResponse, error) {
+	page := url.Values{}
+	for _, key := range []string{"before", "offset", "before_id"} {
+		if v.Has(key) {
+			page.Set(key, v.Get(key))
+		}
+	}
+	resp, err := a.fetchWithRetry(ctx, path, v)
+	if err != nil {
+		return nil, &FetchError{Hostname: a.Hostname, Path: path, Page: page.Encode(), Err: err}
+	}
+	return resp, nil
+}
+
+func (a *Agent) fetchWithRetry(ctx context.Context, path string, v url.Values) (*TumblrResponse, error) {
+	baseURL := a.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/v2/blog/" + a.Hostname + "/" + path)
+	if err != nil {
+		return nil, err
+	}
+
+	v.Set("api_key", a.ApiKey)
+	u.RawQuery = v.Encode()
+
+	// network errors and 5xx are retried with backoff, so that a momentary
+	// failure does not abort paging.
+	var rateLimited, failed int
+	backoff := fetchRetryBackoff
+	for {
+		jsonResp, err := a.get(ctx, u.String())
+		if err == nil || ctx.Err() != nil {
+			return jsonResp, err
+		}
+
+		var wait time.Duration
+		var rateErr *RateLimitError
+		switch {
+		case errors.As(err, &rateErr):
+			rateLimited++
+			if rateLimited > maxRateLimitRetries {
+				return nil, err
+			}
+			a.Warn("rate limited. retry after ", rateErr.RetryAfter)
+			wait = rateErr.RetryAfter
+		case isRetryable(err):
+			failed++
+			if failed > maxFetchRetries {
+				return nil, err
+			}
+			a.Warn("got err ", err, ". retry fetch (attempt ", failed, ") after ", backoff)
+			wait = backoff
+			backoff *= 2
+		default:
+			return nil, err
+		}
+
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (a *Agent) get(ctx context.Context, u string) (*TumblrResponse, error) {
+	a.Debug("access to ", u)
+
+	// timeout of a request may be resolved by retrying, but cancel of parent
+	// context is not.
+	parent := ctx
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+
+	req, err := a.client().NewRequest(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := a.client().Do(req)
+
+	if err != nil {
+		if parent.Err() != nil {
+			return nil, err
+		}
+		return nil, &temporaryError{err}
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	if resp.StatusCode >= 500 {
+		return nil, &StatusError{Url: u, StatusCode: resp.StatusCode}
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &BlogNotFoundError{Hostname: a.Hostname, Msg: resp.Status}
+	}
+
+	var jsonResp TumblrResponse
+	dec := json.NewDecoder(resp.Body)
+	if err := dec.Decode(&jsonResp); err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, &APIError{StatusCode: resp.StatusCode, Msg: resp.Status}
+		}
+		if ctx.Err() != nil && parent.Err() == nil {
+			return nil, &temporaryError{err}
+		}
+		return nil, err
+	}
+
+	switch jsonResp.Meta.Status {
+	case 200:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, &BlogNotFoundError{Hostname: a.Hostname, Msg: jsonResp.Meta.Msg}
+	default:
+		return nil, &APIError{StatusCode: jsonResp.Meta.Status, Msg: jsonResp.Meta.Msg}
+	}
+	return &jsonResp, nil
+}
+
+const (
+	maxRateLimitRetries = 3
+	defaultRetryAfter   = time.Minute
+	maxFetchRetries     = 3
+	fetchRetryBackoff   = 2 * time.Second
+)
+
+var (
+	ErrRateLimited  = errors.New("rate limited")
+	ErrNotFound     = errors.New("not found")
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// APIError is returned when tumblr api responds with unexpected meta status.
+type APIError struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("tumblr error %d: %s", e.StatusCode, e.Msg)
+}
+
+// Is maps status code to ErrRateLimited, ErrNotFound or ErrUnauthorized.
+func (e *APIError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusTooManyRequests:
+		return target == ErrRateLimited
+	case http.StatusNotFound, http.StatusGone:
+		return target == ErrNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return target == ErrUnauthorized
+	}
+	return false
+}
+
+// ErrorCategory is kind of error of agent, which tells how it is handled.
+type ErrorCategory int
+
+const (
+	CategoryOther ErrorCategory = iota
+	// CategoryTemporary is network error or 5xx, which may be resolved by
+	// retrying.
+	CategoryTemporary
+	CategoryRateLimited
+	CategoryNotFound
+	CategoryUnauthorized
+	// CategoryCanceled is cancel or deadline of context.
+	CategoryCanceled
+)
+
+var categoryNames = map[ErrorCategory]string{
+	CategoryOther:        "other",
+	CategoryTemporary:    "temporary",
+	CategoryRateLimited:  "rate_limited",
+	CategoryNotFound:     "not_found",
+	CategoryUnauthorized: "unauthorized",
+	CategoryCanceled:     "canceled",
+}
+
+func (c ErrorCategory) String() string {
+	return categoryNames[c]
+}
+
+// Categorize returns category of err.
+func Categorize(err error) ErrorCategory {
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		return CategoryRateLimited
+	case errors.Is(err, ErrNotFound):
+		return CategoryNotFound
+	case errors.Is(err, ErrUnauthorized):
+		return CategoryUnauthorized
+	case errors.Is(err, context.Canceled):
+		return CategoryCanceled
+	case isRetryable(err):
+		// it includes timeout of a request.
+		return CategoryTemporary
+	case errors.Is(err, context.DeadlineExceeded):
+		return CategoryCanceled
+	}
+	return CategoryOther
+}
+
+// FetchError is returned when agent fails to fetch a page. it tells blog and
+// position of paging where it failed.
+type FetchError struct {
+	Hostname string
+	Path     string
+	// Page is position of page like "before=1700000000" or "offset=40".
+	// empty means first page.
+	Page string
+	Err  error
+}
+
+func (e *FetchError) Error() string {
+	page := e.Page
+	if page == "" {
+		page = "first page"
+	}
+	return fmt.Sprintf("failed to fetch %s of %s at %s: %s", e.Path, e.Hostname, page, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Category returns category of underlying error.
+func (e *FetchError) Category() ErrorCategory {
+	return Categorize(e.Err)
+}
+
+// RateLimitError is returned when tumblr api responds 429.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("tumblr error 429: rate limited. retry after %s", e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// BlogNotFoundError is returned when blog does not exist, or is not available
+// like suspended one.
+type BlogNotFoundError struct {
+	Hostname string
+	Msg      string
+}
+
+func (e *BlogNotFoundError) Error() string {
+	return fmt.Sprintf("blog %s is not found: %s", e.Hostname, e.Msg)
+}
+
+func (e *BlogNotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// parseRetryAfter parses Retry-After header which is either seconds or http date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return defaultRetryAfter
+	}
+	if sec, err := strconv.Atoi(v); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
+
+const (
+	agentMaxRetries   = 3
+	agentRetryBackoff = 30 * time.Second
+)
+
+// RunWithRetry runs agent and retries it with backoff on failure. last id of
+// agent is kept, so retry resumes from it.
+func (a *Agent) RunWithRetry(ctx context.Context, q chan<- Item) error {
+	backoff := agentRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := a.Run(ctx, q)
+		if err == nil || ctx.Err() != nil || attempt > agentMaxRetries {
+			return err
+		}
+		switch Categorize(err) {
+		case CategoryRateLimited:
+			// Fetch already waited for rate limit. leave it to next cycle.
+			return err
+		case CategoryNotFound, CategoryUnauthorized:
+			return err
+		}
+		a.Warn("got err ", err, ". retry (attempt ", attempt, ") after ", backoff)
+		if err := sleep(ctx, backoff); err != nil {
+			return err
+		}
+		backoff *= 2
+	}
+}
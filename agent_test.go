@@ -0,0 +1,559 @@
+package tumblream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testHostname = "example.tumblr.com"
+
+// mockTumblr serves posts api of testHostname. posts are sorted newest first
+// and paged by before and limit in same way as tumblr.
+type mockTumblr struct {
+	*httptest.Server
+	posts []TumblrResponsePost
+	// queue is queued posts, which are served in order of publishing by
+	// offset.
+	queue []TumblrResponsePost
+	// likes is liked posts, which are sorted by LikedTimestamp newest first.
+	likes []TumblrResponsePost
+	// emptyBefore makes pages before it empty, as if older posts are not
+	// available.
+	emptyBefore int64
+	requests    atomic.Int64
+}
+
+func newMockTumblr(t *testing.T, posts []TumblrResponsePost) *mockTumblr {
+	t.Helper()
+	m := &mockTumblr{posts: posts}
+	sort.Slice(m.posts, func(i, j int) bool { return m.posts[i].Id > m.posts[j].Id })
+	m.Server = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockTumblr) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v2/blog/"+testHostname+"/likes" {
+		m.serveLikes(w, r)
+		return
+	}
+	prefix := "/v2/blog/" + testHostname + "/posts/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	m.requests.Add(1)
+	typ := strings.TrimPrefix(r.URL.Path, prefix)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+
+	var resp TumblrResponse
+	resp.Meta.Status = http.StatusOK
+	resp.Response.Posts = []TumblrResponsePost{}
+	if typ == StateQueue {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		resp.Response.TotalPosts = int64(len(m.queue))
+		for i := offset; i < len(m.queue) && i < offset+limit; i++ {
+			resp.Response.Posts = append(resp.Response.Posts, m.queue[i])
+		}
+		json.NewEncoder(w).Encode(&resp)
+		return
+	}
+	// legacy api returns posts made in NPF as text posts without content.
+	npf := r.URL.Query().Get("npf") == "true"
+	for _, post := range m.posts {
+		if post.Type != typ {
+			continue
+		}
+		if !npf {
+			post.Content = nil
+			post.Trail = nil
+		}
+		resp.Response.TotalPosts++
+		if before != 0 && post.Timestamp >= before {
+			continue
+		}
+		if m.emptyBefore != 0 && post.Timestamp < m.emptyBefore {
+			continue
+		}
+		if len(resp.Response.Posts) < limit {
+			resp.Response.Posts = append(resp.Response.Posts, post)
+		}
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// serveLikes serves liked posts liked before before.
+func (m *mockTumblr) serveLikes(w http.ResponseWriter, r *http.Request) {
+	m.requests.Add(1)
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+
+	var resp TumblrResponse
+	resp.Meta.Status = http.StatusOK
+	resp.Response.LikedPosts = []TumblrResponsePost{}
+	resp.Response.LikedCount = int64(len(m.likes))
+	for _, post := range m.likes {
+		if before != 0 && post.LikedTimestamp >= before {
+			continue
+		}
+		if len(resp.Response.LikedPosts) < limit {
+			resp.Response.LikedPosts = append(resp.Response.LikedPosts, post)
+		}
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// testPost returns photo post of id with n photos. timestamp grows with id.
+func testPost(id int64, n int) TumblrResponsePost {
+	post := TumblrResponsePost{Id: id, Type: "photo", Timestamp: 1700000000 + id}
+	for i := 0; i < n; i++ {
+		src := fmt.Sprintf("https://64.media.tumblr.com/%d_%d_1280.jpg", id, i)
+		post.Photos = append(post.Photos, TumblrResponsePhoto{
+			AltSizes: []TumblrResponsePhotoSize{{Width: 1280, Height: 960, Url: src}},
+		})
+	}
+	return post
+}
+
+func newTestAgent(m *mockTumblr) *Agent {
+	return &Agent{
+		Hostname:  testHostname,
+		ApiKey:    "key",
+		Size:      "largest",
+		Types:     []string{"photo"},
+		BaseURL:   m.URL,
+		Client:    &Client{HTTPClient: m.Client()},
+		PageLimit: 2,
+	}
+}
+
+// runAgent runs a cycle of agent and returns queued items.
+func runAgent(t *testing.T, a *Agent) []Item {
+	t.Helper()
+	a.Reset()
+	q := make(chan Item, 100)
+	if err := a.Run(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	close(q)
+	var items []Item
+	for item := range q {
+		items = append(items, item)
+	}
+	return items
+}
+
+func postIds(items []Item) []int64 {
+	var ids []int64
+	for _, item := range items {
+		if len(ids) == 0 || ids[len(ids)-1] != item.PostId {
+			ids = append(ids, item.PostId)
+		}
+	}
+	return ids
+}
+
+func equalIds(a, b []int64) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func testPosts() []TumblrResponsePost {
+	return []TumblrResponsePost{
+		testPost(600, 1),
+		testPost(500, 3),
+		testPost(400, 1),
+		testPost(300, 1),
+		testPost(200, 1),
+		testPost(100, 1),
+	}
+}
+
+func TestAgentFirstRunRecordsLastId(t *testing.T) {
+	m := newMockTumblr(t, testPosts())
+	a := newTestAgent(m)
+
+	items := runAgent(t, a)
+	if len(items) != 0 {
+		t.Errorf("queued %d items in first run", len(items))
+	}
+	if a.LastId() != 600 {
+		t.Errorf("last id is %d, want 600", a.LastId())
+	}
+	// a page of photo and text posts each.
+	if n := m.requests.Load(); n != 2 {
+		t.Errorf("requested %d pages, want 2", n)
+	}
+}
+
+func TestAgentQueuesOnlyNewerPosts(t *testing.T) {
+	m := newMockTumblr(t, testPosts()[2:])
+	a := newTestAgent(m)
+	runAgent(t, a)
+
+	m.posts = testPosts()
+	items := runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{600, 500}) {
+		t.Errorf("queued posts %v, want [600 500]", ids)
+	}
+	if a.LastId() != 600 {
+		t.Errorf("last id is %d, want 600", a.LastId())
+	}
+
+	items = runAgent(t, a)
+	if len(items) != 0 {
+		t.Errorf("queued %d items without new posts", len(items))
+	}
+}
+
+func TestAgentStopsPagingAtLastId(t *testing.T) {
+	m := newMockTumblr(t, testPosts())
+	a := newTestAgent(m)
+	a.SetLastId(300)
+
+	items := runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{600, 500, 400}) {
+		t.Errorf("queued posts %v, want [600 500 400]", ids)
+	}
+	// pages overlap by oldest post of previous one, so 300 is in third page
+	// and pages older than it are not fetched. text posts are in a page.
+	if n := m.requests.Load(); n != 4 {
+		t.Errorf("requested %d pages, want 4", n)
+	}
+}
+
+func TestAgentMaxPostsResumesPaging(t *testing.T) {
+	m := newMockTumblr(t, testPosts())
+	a := newTestAgent(m)
+	a.MaxPosts = 2
+	a.SetLastId(100)
+
+	items := runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{600, 500}) {
+		t.Errorf("queued posts %v, want [600 500]", ids)
+	}
+	// paging stops at max posts instead of paging to last id.
+	if n := m.requests.Load(); n != 2 {
+		t.Errorf("requested %d pages, want 2", n)
+	}
+	if a.LastId() != 100 {
+		t.Errorf("last id is %d, want 100", a.LastId())
+	}
+
+	// posts made while backlog is paged are queued after it.
+	m.posts = append([]TumblrResponsePost{testPost(700, 1)}, m.posts...)
+	items = runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{400, 300}) {
+		t.Errorf("queued posts %v, want [400 300]", ids)
+	}
+	items = runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{200}) {
+		t.Errorf("queued posts %v, want [200]", ids)
+	}
+	if a.LastId() != 600 {
+		t.Errorf("last id is %d, want 600", a.LastId())
+	}
+	items = runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{700}) {
+		t.Errorf("queued posts %v, want [700]", ids)
+	}
+}
+
+func TestAgentOverPagingLastId(t *testing.T) {
+	// post of last id is deleted.
+	m := newMockTumblr(t, testPosts())
+	a := newTestAgent(m)
+	a.SetLastId(350)
+
+	items := runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{600, 500, 400}) {
+		t.Errorf("queued posts %v, want [600 500 400]", ids)
+	}
+	if a.LastId() != 600 {
+		t.Errorf("last id is %d, want 600", a.LastId())
+	}
+}
+
+func TestAgentPhotoset(t *testing.T) {
+	m := newMockTumblr(t, testPosts())
+	a := newTestAgent(m)
+	a.SetLastId(400)
+
+	items := runAgent(t, a)
+	if len(items) != 4 {
+		t.Fatalf("queued %d items, want 4", len(items))
+	}
+	for i, item := range items[1:] {
+		if item.PostId != 500 || item.Index != i {
+			t.Errorf("item %d of photoset is post %d index %d", i, item.PostId, item.Index)
+		}
+		if want := fmt.Sprintf("https://64.media.tumblr.com/500_%d_1280.jpg", i); item.Url != want {
+			t.Errorf("url of item %d is %s, want %s", i, item.Url, want)
+		}
+	}
+}
+
+// npfPost returns text post of id made in NPF with an image block of each
+// url.
+func npfPost(id int64, urls ...string) TumblrResponsePost {
+	post := TumblrResponsePost{Id: id, Type: "text", Timestamp: 1700000000 + id}
+	for _, u := range urls {
+		media, _ := json.Marshal([]TumblrResponsePhotoSize{{Width: 1280, Height: 960, Url: u}})
+		post.Content = append(post.Content, TumblrResponseBlock{Type: "image", Media: media})
+	}
+	post.Content = append(post.Content, TumblrResponseBlock{Type: "text"})
+	return post
+}
+
+func TestAgentNPFPosts(t *testing.T) {
+	posts := append(testPosts(),
+		npfPost(650, "https://64.media.tumblr.com/650_0_1280.jpg", "https://64.media.tumblr.com/650_1_1280.jpg"),
+		// text only.
+		npfPost(550),
+	)
+	m := newMockTumblr(t, posts)
+	a := newTestAgent(m)
+	a.SetLastId(400)
+
+	items := runAgent(t, a)
+	var urls []string
+	for _, item := range items {
+		if item.PostId == 650 {
+			urls = append(urls, item.Url)
+		}
+		if item.PostId == 550 {
+			t.Errorf("text post without images is queued: %+v", item)
+		}
+	}
+	if len(urls) != 2 {
+		t.Errorf("queued %q of post in NPF, want 2 urls", urls)
+	}
+	if a.LastId() != 650 {
+		t.Errorf("last id is %d, want 650", a.LastId())
+	}
+	if n := a.Stats().Posts.Load(); n != 3 {
+		t.Errorf("posts is %d, want 3", n)
+	}
+}
+
+// testLike returns photo post of id liked at likedTimestamp.
+func testLike(id int64, likedTimestamp int64) TumblrResponsePost {
+	post := testPost(id, 1)
+	post.LikedTimestamp = likedTimestamp
+	return post
+}
+
+func TestAgentLikesInSameSecond(t *testing.T) {
+	m := newMockTumblr(t, nil)
+	m.likes = []TumblrResponsePost{
+		testLike(1, 1700000100),
+		testLike(2, 1700000100),
+		testLike(3, 1700000098),
+		// second page starts in same second as end of first one.
+		testLike(4, 1700000097),
+		testLike(5, 1700000097),
+		testLike(6, 1700000096),
+	}
+	for _, prefetch := range []bool{false, true} {
+		a := newTestAgent(m)
+		a.Source = SourceLikes
+		a.Prefetch = prefetch
+		a.PageLimit = 3
+		a.SetLastId(1700000090)
+
+		items := runAgent(t, a)
+		if ids := postIds(items); !equalIds(ids, []int64{1, 2, 3, 4, 5, 6}) {
+			t.Errorf("prefetch %v: queued posts %v, want [1 2 3 4 5 6]", prefetch, ids)
+		}
+		if a.LastId() != 1700000100 {
+			t.Errorf("prefetch %v: last id is %d, want 1700000100", prefetch, a.LastId())
+		}
+	}
+}
+
+func TestAgentLikesMatchTypes(t *testing.T) {
+	m := newMockTumblr(t, nil)
+	video := testLike(2, 1700000099)
+	video.Type = "video"
+	video.Photos = nil
+	video.VideoUrl = "https://va.media.tumblr.com/tumblr_2.mp4"
+	m.likes = []TumblrResponsePost{testLike(1, 1700000100), video, testLike(3, 1700000098)}
+
+	a := newTestAgent(m)
+	a.Source = SourceLikes
+	a.SetLastId(1700000090)
+	items := runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{1, 3}) {
+		t.Errorf("queued posts %v, want [1 3]", ids)
+	}
+	if n := a.Stats().Posts.Load(); n != 2 {
+		t.Errorf("posts is %d, want 2", n)
+	}
+	// liked video is not saved, but it is paged.
+	if a.LastId() != 1700000100 {
+		t.Errorf("last id is %d, want 1700000100", a.LastId())
+	}
+
+	a.Types = []string{"photo", "video"}
+	a.SetLastId(1700000090)
+	items = runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{1, 2, 3}) {
+		t.Errorf("queued posts %v, want [1 2 3]", ids)
+	}
+}
+
+func TestAgentEmptyPage(t *testing.T) {
+	t.Run("no posts", func(t *testing.T) {
+		m := newMockTumblr(t, nil)
+		a := newTestAgent(m)
+		a.SetLastId(100)
+		if items := runAgent(t, a); len(items) != 0 {
+			t.Errorf("queued %d items", len(items))
+		}
+		if a.LastId() != 100 {
+			t.Errorf("last id is %d, want 100", a.LastId())
+		}
+	})
+
+	t.Run("empty page before last id", func(t *testing.T) {
+		m := newMockTumblr(t, testPosts())
+		m.emptyBefore = testPost(400, 0).Timestamp
+		a := newTestAgent(m)
+		a.SetLastId(100)
+
+		items := runAgent(t, a)
+		if ids := postIds(items); !equalIds(ids, []int64{600, 500, 400}) {
+			t.Errorf("queued posts %v, want [600 500 400]", ids)
+		}
+		if a.LastId() != 600 {
+			t.Errorf("last id is %d, want 600", a.LastId())
+		}
+	})
+}
+
+func TestAgentMediaUrlsSkipsUnusableSizes(t *testing.T) {
+	post := &TumblrResponsePost{Id: 100, Type: "photo", Photos: []TumblrResponsePhoto{
+		{AltSizes: []TumblrResponsePhotoSize{
+			{Width: 1280, Height: 960},
+			{Width: 500, Height: 375, Url: "https://64.media.tumblr.com/a_500.jpg"},
+		}},
+		// no alt sizes.
+		{},
+		// sizes without url.
+		{AltSizes: []TumblrResponsePhotoSize{{Width: 1280, Height: 960}, {Width: 500, Height: 375}}},
+		{AltSizes: []TumblrResponsePhotoSize{{Width: 1280, Height: 960, Url: "https://64.media.tumblr.com/b_1280.jpg"}}},
+	}}
+
+	for _, a := range []*Agent{
+		{Size: "largest"},
+		{Sizes: []string{"1280", "500"}},
+		{Size: "largest", MinWidth: 100},
+	} {
+		urls := a.mediaUrls(post)
+		if len(urls) != 2 {
+			t.Fatalf("mediaUrls() = %+v, want 2 urls", urls)
+		}
+		for i, u := range urls {
+			if u.Url == "" {
+				t.Errorf("mediaUrls() has empty url: %+v", urls)
+			}
+			// indexes are sequential among usable photos.
+			if u.Index != i {
+				t.Errorf("index of %s is %d, want %d", u.Url, u.Index, i)
+			}
+		}
+	}
+}
+
+// TestAgentPrefetchLastIdRace runs agent with Prefetch while others read and
+// write last id, like state writer and health check do. run with -race.
+func TestAgentPrefetchLastIdRace(t *testing.T) {
+	var posts []TumblrResponsePost
+	for id := int64(1); id <= 40; id++ {
+		posts = append(posts, testPost(id*10, 1))
+	}
+	m := newMockTumblr(t, posts)
+	a := newTestAgent(m)
+	a.Prefetch = true
+	a.SetLastId(10)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(100 * time.Microsecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			a.SetLastId(a.LastId())
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		runAgent(t, a)
+	}
+	close(done)
+	wg.Wait()
+
+	// stale id may be written back by the goroutine, so last id is either
+	// of them.
+	if id := a.LastId(); id != 10 && id != 400 {
+		t.Errorf("last id is %d, want 10 or 400", id)
+	}
+}
+
+func TestAgentQueue(t *testing.T) {
+	m := newMockTumblr(t, nil)
+	// ids of queued posts are ascending.
+	for id := int64(1); id <= 5; id++ {
+		m.queue = append(m.queue, testPost(id, 1))
+	}
+	a := newTestAgent(m)
+	a.States = []string{StateQueue}
+
+	items := runAgent(t, a)
+	if ids := postIds(items); !equalIds(ids, []int64{1, 2, 3, 4, 5}) {
+		t.Errorf("queued posts %v, want [1 2 3 4 5]", ids)
+	}
+	// last page is short, so no more pages are fetched.
+	if n := m.requests.Load(); n != 3 {
+		t.Errorf("requested %d pages, want 3", n)
+	}
+}
+
+func TestCategorizeContextErrors(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(s.Close)
+	a := &Agent{Hostname: testHostname, Client: &Client{HTTPClient: s.Client()}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := a.get(ctx, s.URL)
+	if c := Categorize(err); c != CategoryCanceled {
+		t.Errorf("canceled request is %v, want %v", c, CategoryCanceled)
+	}
+
+	// timeout of a request is retried.
+	a.Timeout = 10 * time.Millisecond
+	_, err = a.get(context.Background(), s.URL)
+	if c := Categorize(err); c != CategoryTemporary {
+		t.Errorf("timed out request is %v, want %v", c, CategoryTemporary)
+	}
+}
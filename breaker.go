@@ -0,0 +1,58 @@
+package tumblream
+
+// maxBreakerSkip is max number of cycles skipped by open Breaker.
+const maxBreakerSkip = 64
+
+// Breaker is circuit breaker of a blog. after Threshold cycles fail in a row,
+// it opens and the blog is skipped for 1, 2, 4... cycles until a cycle
+// succeeds. nil or zero Threshold never opens.
+type Breaker struct {
+	Threshold int
+
+	failures int
+	// skip is number of cycles left to skip.
+	skip int
+}
+
+// Allow reports whether blog runs in this cycle. skipped cycle is counted by
+// it, so it must be called once per cycle.
+func (b *Breaker) Allow() bool {
+	if b == nil || b.skip == 0 {
+		return true
+	}
+	b.skip--
+	return false
+}
+
+// Open reports whether failures reached Threshold.
+func (b *Breaker) Open() bool {
+	return b != nil && b.Threshold > 0 && b.failures >= b.Threshold
+}
+
+// Success closes breaker. it returns true when breaker was open.
+func (b *Breaker) Success() bool {
+	if b == nil {
+		return false
+	}
+	open := b.Open()
+	b.failures = 0
+	b.skip = 0
+	return open
+}
+
+// Failure counts failed cycle, and returns number of cycles to skip. it is 0
+// while breaker is closed.
+func (b *Breaker) Failure() int {
+	if b == nil {
+		return 0
+	}
+	b.failures++
+	if !b.Open() {
+		return 0
+	}
+	b.skip = maxBreakerSkip
+	if n := b.failures - b.Threshold; n < 6 {
+		b.skip = 1 << n
+	}
+	return b.skip
+}
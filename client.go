@@ -0,0 +1,61 @@
+package tumblream
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// DefaultUserAgent is User-Agent of Client whose UserAgent is empty.
+const DefaultUserAgent = "tumblream"
+
+// Client sends requests to tumblr api and media servers. zero value is ready
+// to use.
+type Client struct {
+	// HTTPClient sends requests. http.DefaultClient is used when it is nil.
+	HTTPClient *http.Client
+	// UserAgent is User-Agent header of requests.
+	UserAgent string
+	// OAuth signs requests when it is not nil.
+	OAuth *OAuth
+}
+
+// NewRequest returns GET request with User-Agent.
+func (c *Client) NewRequest(ctx context.Context, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	userAgent := c.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return req, nil
+}
+
+// Do sends req. req is signed when OAuth is set.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	if c.OAuth != nil {
+		if err := c.OAuth.Sign(req); err != nil {
+			return nil, err
+		}
+	}
+	if c.HTTPClient != nil {
+		return c.HTTPClient.Do(req)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// sleep waits for d. it returns error of ctx when ctx is done before that.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soh335/tumblream"
+)
+
+// Config is configuration of tumblream. it is loaded from json file given by
+// --config, and flags override values of it.
+type Config struct {
+	ApiKey   string       `json:"api_key"`
+	Dir      string       `json:"dir"`
+	Interval Duration     `json:"interval"`
+	Size     string       `json:"size"`
+	Types    []string     `json:"types"`
+	Blogs    []BlogConfig `json:"blogs"`
+}
+
+// BlogConfig is configuration of a blog. empty fields are filled by values of
+// Config.
+type BlogConfig struct {
+	Hostname string   `json:"hostname"`
+	ApiKey   string   `json:"api_key"`
+	Size     string   `json:"size"`
+	Types    []string `json:"types"`
+	// ResumeFrom is post id to start from when there is no last id in state.
+	ResumeFrom int64 `json:"resume_from"`
+}
+
+// Duration is time.Duration which is decoded from string like "30m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// ByteSize is size in bytes which is parsed from string like "25MB". it
+// implements flag.Value.
+type ByteSize int64
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"TB", 1 << 40},
+	{"B", 1},
+}
+
+func ParseByteSize(s string) (ByteSize, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	unit := int64(1)
+	for _, u := range byteSizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			unit = u.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return ByteSize(n * float64(unit)), nil
+}
+
+func (b *ByteSize) Set(s string) error {
+	v, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = v
+	return nil
+}
+
+func (b *ByteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func byteSizeFlag(name string, value ByteSize, usage string) *ByteSize {
+	p := new(ByteSize)
+	*p = value
+	flag.Var(p, name, usage)
+	return p
+}
+
+// ByteRate is bytes per second. it is parsed like ByteSize with optional
+// "/s" suffix (e.g. 2MB/s).
+type ByteRate int64
+
+func (b *ByteRate) Set(s string) error {
+	v, err := ParseByteSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+	if err != nil {
+		return fmt.Errorf("invalid rate: %s", s)
+	}
+	*b = ByteRate(v)
+	return nil
+}
+
+func (b *ByteRate) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func byteRateFlag(name string, value ByteRate, usage string) *ByteRate {
+	p := new(ByteRate)
+	*p = value
+	flag.Var(p, name, usage)
+	return p
+}
+
+// ParseNewerThan parses s as date (2006-01-02 or RFC3339) or duration before
+// now. duration accepts "d" suffix for days in addition to time.ParseDuration.
+func ParseNewerThan(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.ParseFloat(days, 64); err == nil && n >= 0 {
+			return now.Add(-time.Duration(n * 24 * float64(time.Hour))), nil
+		}
+	} else if d, err := time.ParseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid newer-than: %s", s)
+}
+
+// NormalizeHostname strips scheme, path and spaces from s, so that pasted url
+// like "https://example.tumblr.com/" becomes "example.tumblr.com".
+func NormalizeHostname(s string) (string, error) {
+	hostname := strings.TrimSpace(s)
+	if i := strings.Index(hostname, "://"); i >= 0 {
+		hostname = hostname[i+3:]
+	}
+	if i := strings.IndexAny(hostname, "/?#"); i >= 0 {
+		hostname = hostname[:i]
+	}
+	hostname = strings.ToLower(hostname)
+
+	if hostname == "" {
+		return "", fmt.Errorf("empty hostname: %q", s)
+	}
+	for _, r := range hostname {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_') {
+			return "", fmt.Errorf("invalid hostname: %q", s)
+		}
+	}
+	return hostname, nil
+}
+
+func LoadConfig(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var c Config
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("failed to load config %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+// ApplyFlags overrides config by flags. when all is true, every flag is applied
+// even if it is not set in command line. some flags fall back to environment
+// variables when they are not set. blogs in --hostnames-file are added to
+// blogs of config or --hostnames.
+func (c *Config) ApplyFlags(all bool) error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	use := func(name string) bool {
+		return all || set[name]
+	}
+	useEnv := func(name string, value string, env string) (string, bool) {
+		if set[name] {
+			return value, true
+		}
+		if v := os.Getenv(env); v != "" {
+			return v, true
+		}
+		return value, all
+	}
+
+	if v, ok := useEnv("apikey", *apiKey, "TUMBLR_API_KEY"); ok {
+		c.ApiKey = v
+	}
+	if v, ok := useEnv("dir", *dir, "TUMBLREAM_DIR"); ok {
+		c.Dir = v
+	}
+	if use("interval") || c.Interval.Duration == 0 {
+		c.Interval = Duration{*interval}
+	}
+	if use("size") || c.Size == "" {
+		c.Size = *size
+	}
+	if use("types") || len(c.Types) == 0 {
+		c.Types = strings.Split(*types, ",")
+	}
+	if v, ok := useEnv("hostnames", *hostnames, "TUMBLR_HOSTNAMES"); ok {
+		c.Blogs = nil
+		if v != "" {
+			c.Blogs = parseHostnames(strings.Split(v, ","))
+		}
+	}
+	if *hostnamesFile != "" {
+		entries, err := ReadHostnamesFile(*hostnamesFile)
+		if err != nil {
+			return err
+		}
+		c.Blogs = append(c.Blogs, parseHostnames(entries)...)
+	}
+
+	for i := range c.Blogs {
+		b := &c.Blogs[i]
+		if b.ApiKey == "" {
+			b.ApiKey = c.ApiKey
+		}
+		if b.Size == "" {
+			b.Size = c.Size
+		}
+		if len(b.Types) == 0 {
+			b.Types = c.Types
+		}
+		if use("resume-from") {
+			b.ResumeFrom = *resumeFrom
+		}
+	}
+	return nil
+}
+
+// parseHostnames parses entries of --hostnames. entry is "hostname" or
+// "hostname=apikey".
+func parseHostnames(entries []string) []BlogConfig {
+	var blogs []BlogConfig
+	for _, entry := range entries {
+		hostname, key, _ := strings.Cut(entry, "=")
+		blogs = append(blogs, BlogConfig{
+			Hostname: strings.TrimSpace(hostname),
+			ApiKey:   strings.TrimSpace(key),
+		})
+	}
+	return blogs
+}
+
+// ReadHostnamesFile reads entries of hostnames from file, one per line. blank
+// lines and text after "#" are ignored.
+func ReadHostnamesFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hostnames file: %s", err)
+	}
+	var entries []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, nil
+}
+
+// Validate validates config. hostnames of blogs are normalized by it, and
+// duplicated blogs are removed except first one.
+func (c *Config) Validate() error {
+	if len(c.Blogs) == 0 {
+		return errors.New("hostnames are required. set --hostnames, --hostnames-file or TUMBLR_HOSTNAMES")
+	}
+	if c.Interval.Duration <= 0 {
+		return fmt.Errorf("interval must be positive: %s", c.Interval)
+	}
+	if err := tumblream.ValidateSize(c.Size); err != nil {
+		return err
+	}
+	if err := tumblream.ValidateTypes(c.Types); err != nil {
+		return err
+	}
+	for i := range c.Blogs {
+		b := &c.Blogs[i]
+		hostname, err := NormalizeHostname(b.Hostname)
+		if err != nil {
+			return err
+		}
+		b.Hostname = hostname
+		if b.ApiKey == "" {
+			return fmt.Errorf("%s: api key is required. set --apikey or TUMBLR_API_KEY", b.Hostname)
+		}
+		if err := tumblream.ValidateSize(b.Size); err != nil {
+			return fmt.Errorf("%s: %s", b.Hostname, err)
+		}
+		if err := tumblream.ValidateTypes(b.Types); err != nil {
+			return fmt.Errorf("%s: %s", b.Hostname, err)
+		}
+		if b.ResumeFrom < 0 {
+			return fmt.Errorf("%s: resume from must be positive post id: %d", b.Hostname, b.ResumeFrom)
+		}
+	}
+
+	seen := map[string]bool{}
+	blogs := c.Blogs[:0]
+	for _, b := range c.Blogs {
+		if seen[b.Hostname] {
+			continue
+		}
+		seen[b.Hostname] = true
+		blogs = append(blogs, b)
+	}
+	c.Blogs = blogs
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// health serves /healthz and /readyz for liveness and readiness probes.
+type health struct {
+	// maxAge is max duration since last successful cycle (or start)
+	// regarded as alive.
+	maxAge time.Duration
+
+	mu        sync.Mutex
+	started   time.Time
+	lastCycle time.Time
+}
+
+func newHealth(maxAge time.Duration) *health {
+	return &health{maxAge: maxAge, started: time.Now()}
+}
+
+// CycleDone records that a cycle is completed and some agents succeeded in
+// it.
+func (h *health) CycleDone() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastCycle = time.Now()
+}
+
+func (h *health) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/readyz", h.serveReadyz)
+	return mux
+}
+
+// serveHealthz responds 503 when no cycle is completed within maxAge.
+func (h *health) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	last := h.lastCycle
+	if last.IsZero() {
+		last = h.started
+	}
+	h.mu.Unlock()
+
+	if time.Since(last) > h.maxAge {
+		http.Error(w, "no cycle is completed since "+last.Format(time.RFC3339), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// serveReadyz responds 200 after first cycle is completed.
+func (h *health) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	ready := !h.lastCycle.IsZero()
+	h.mu.Unlock()
+
+	if !ready {
+		http.Error(w, "first cycle is not completed", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
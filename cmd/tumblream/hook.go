@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/soh335/tumblream"
+)
+
+// runHook runs command by sh after file of item is saved to path. path is
+// passed as $1 and TUMBLREAM_FILE, and metadata of post as environment
+// variables. command is killed after timeout unless it is 0. failure of
+// command is only logged.
+func runHook(ctx context.Context, command string, timeout time.Duration, path string, item tumblream.Item) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command, "tumblream-hook", path)
+	killGroup(cmd)
+	cmd.Env = append(os.Environ(),
+		"TUMBLREAM_FILE="+path,
+		"TUMBLREAM_BLOG="+item.Hostname,
+		"TUMBLREAM_POST_ID="+strconv.FormatInt(item.PostId, 10),
+		"TUMBLREAM_POST_URL="+item.PostUrl,
+		"TUMBLREAM_URL="+item.Url,
+		"TUMBLREAM_TIMESTAMP="+strconv.FormatInt(item.Timestamp, 10),
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		logger.Log(tumblream.LevelWarn, "hook", item.Hostname, fmt.Sprint("post-hook for ", path, " failed: ", err))
+	}
+}
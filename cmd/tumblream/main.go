@@ -0,0 +1,986 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/soh335/tumblream"
+)
+
+var (
+	configFile       = flag.String("config", "", "path of json config file. flags override values of it")
+	apiKey           = flag.String("apikey", "", "api key of tumblr (env TUMBLR_API_KEY)")
+	oauthConsumerKey = flag.String("oauth-consumer-key", "", "consumer key of OAuth. api key is used when it is empty")
+	oauthConsumerSec = flag.String("oauth-consumer-secret", "", "consumer secret of OAuth. requests are signed by OAuth when it is set")
+	oauthToken       = flag.String("oauth-token", "", "token of OAuth")
+	oauthSecret      = flag.String("oauth-secret", "", "token secret of OAuth")
+	hostnamesFile    = flag.String("hostnames-file", "", "file of hostnames, one per line in same form as --hostnames. blank lines and # comments are ignored. they are added to --hostnames")
+	hostnames        = flag.String("hostnames", "", "comma separated hostnames of tumblr blog. hostname=apikey overrides api key of the blog (env TUMBLR_HOSTNAMES)")
+	dir              = flag.String("dir", "", "directory of output (env TUMBLREAM_DIR)")
+	size             = flag.String("size", "largest", "size of photo. original, largest, smallest or width in pixel")
+	thumbnails       = flag.Int("thumbnails", 0, "write thumbnail of each saved jpeg, png and gif whose long side is it in pixel under thumbs/ of blog directory. 0 means none")
+	minWidth         = flag.Int("min-width", 0, "skip photos whose largest size is narrower than it in pixel. 0 means unlimited")
+	minHeight        = flag.Int("min-height", 0, "skip photos whose largest size is lower than it in pixel. 0 means unlimited")
+	sizes            = flag.String("sizes", "", "comma separated sizes of photo to save all of them (e.g. 500,original). size is appended to filename. overrides --size")
+	interval         = flag.Duration("interval", 30*time.Minute, "interval of polling (e.g. 15m, 2h)")
+	cycleTimeout     = flag.Duration("cycle-timeout", 0, "max time of agents in a cycle. agents running over it are canceled and retried next cycle. 0 means unlimited")
+	jitter           = flag.Duration("jitter", 0, "max random delay added to interval of each poll (e.g. 5m)")
+	concurrency      = flag.Int("concurrency", 4, "number of concurrent downloads")
+	queueSize        = flag.Int("queue-size", 0, "number of urls buffered for downloads. agents wait when it is full. 0 means twice of concurrency")
+	agentConcurrency = flag.Int("agent-concurrency", 4, "number of blogs fetched concurrently")
+	maxRetries       = flag.Int("max-retries", 3, "max number of retries of failed download")
+	types            = flag.String("types", "photo", "comma separated types of post. photo, video. photo includes images of text posts made in NPF")
+	tags             = flag.String("tags", "", "comma separated tags. only posts which have any of them are saved")
+	exts             = flag.String("ext", "", "comma separated extensions of files to be saved (e.g. jpg,png). empty means all")
+	source           = flag.String("source", tumblream.SourcePosts, "source of posts. posts or likes (posts liked by the blog)")
+	states           = flag.String("state", tumblream.StatePublished, "comma separated states of posts. published, queue and draft. queue and draft require OAuth")
+	reblogs          = flag.String("reblogs", tumblream.ReblogsAll, "which posts are saved about reblog. all, exclude (originals only) or only (reblogs only)")
+	metadata         = flag.Bool("metadata", false, "write metadata of post to <filename>.json. urls whose <filename>.json exists are not downloaded again")
+	redownload       = flag.Bool("redownload-missing", false, "download file again when it does not exist even if its url is saved before or its <filename>.json exists")
+	dedupe           = flag.Bool("dedupe", false, "skip files whose content is same as already saved one")
+	dryRun           = flag.Bool("dry-run", false, "only log urls which would be saved. last id is not persisted")
+	filenameTemplate = flag.String("filename-template", "{{.PostID}}_{{.Index}}_{{.Name}}", "template of file path under blog directory. fields are .Blog, .PostID, .Index (index in post), .Name (last segment of url) and .Ext (extension of .Name like .jpg). it may contain directories like {{.PostID}}/{{.Index}}{{.Ext}}. empty uses .Name")
+	postHook         = flag.String("post-hook", "", "command run by sh after each file is saved. path of file is passed as $1 and TUMBLREAM_FILE, and post as TUMBLREAM_BLOG, TUMBLREAM_POST_ID, TUMBLREAM_POST_URL, TUMBLREAM_URL and TUMBLREAM_TIMESTAMP")
+	postHookTimeout  = flag.Duration("post-hook-timeout", time.Minute, "max time of a post-hook command. it is killed after it and at shutdown. 0 means unlimited")
+	verboseStats     = flag.Bool("stats", false, "log bytes and elapsed time of each saved file")
+	summaryOnlyNew   = flag.Bool("summary-only-new", false, "log summary of cycle only for blogs with new posts or errors. total is always logged")
+	once             = flag.Bool("once", false, "run only one cycle and exit after all downloads finish. exit status is 1 if any error occurred")
+	metricsAddr      = flag.String("metrics-addr", "", "address to serve prometheus metrics on /metrics (e.g. :9090). empty disables it")
+	healthAddr       = flag.String("health-addr", "", "address to serve /healthz and /readyz (e.g. :8080). empty disables it")
+	logLevel         = flag.String("log-level", "info", "min level of log. debug (with api urls), info, warn or error")
+	logFormat        = flag.String("log-format", "text", "format of log. text or json")
+	rateLimit        = byteRateFlag("rate-limit", 0, "max total download speed (e.g. 2MB/s). 0 means unlimited")
+	maxBytes         = byteSizeFlag("max-bytes", 0, "max total bytes saved per cycle (e.g. 10GB). posts after it are left for next cycle. 0 means unlimited")
+	minFree          = byteSizeFlag("min-free", 0, "min free space of output directory (e.g. 1GB). downloads and queueing stop while free space is under it. 0 means unlimited")
+	maxFileSize      = byteSizeFlag("max-file-size", 0, "max size of a file (e.g. 25MB). larger files are skipped. 0 means unlimited")
+	proxy            = flag.String("proxy", "", "url of proxy for all requests (e.g. http://127.0.0.1:8080, socks5://127.0.0.1:1080)")
+	apiURL           = flag.String("api-url", tumblream.DefaultBaseURL, "base url of tumblr api. useful for mock servers and compatible mirrors")
+	tumblrHost       = flag.String("tumblr-host", "", "host[:port] to send api requests instead of host of --api-url, like caching proxy")
+	userAgent        = flag.String("user-agent", "tumblream/"+version, "User-Agent header of requests")
+	printUrls        = flag.Bool("print-urls", false, "print urls of all posts of blogs to stdout instead of saving them, and exit")
+	showStatus       = flag.Bool("status", false, "print last id, last fetched time and number of saved files of each blog, and exit")
+	showVersion      = flag.Bool("version", false, "print version and exit")
+	manifest         = flag.String("manifest", "", "path of append only log of every save")
+	failuresFile     = flag.String("failures-file", "", "path of file where failed downloads are appended")
+	retryFailures    = flag.Bool("retry-failures", false, "retry failed downloads in --failures-file before first cycle")
+	eventsFile       = flag.String("events-file", "", "path of file where events of posts and downloads are appended as json per line")
+	retryBackoff     = flag.Duration("retry-backoff", tumblream.DefaultRetryBackoff, "wait before first retry of download on network error or 5xx. it is doubled by each retry. 429 waits for Retry-After and 404 or 410 are not retried")
+	deadTTL          = flag.Duration("dead-ttl", 0, "urls which responded 404 or 410 are not queued until it passes, then retried once. 0 means forever")
+	verify           = flag.Bool("verify", false, "walk all posts and check existing files by size of remote ones. missing or mismatched files are downloaded again. requires --once")
+	afterId          = flag.Int64("after-id", 0, "only posts whose id is greater than it. runs once to repair holes regardless of last id, which is not updated. requires --once")
+	beforeId         = flag.Int64("before-id", 0, "only posts whose id is less than it. runs once in same way as --after-id. requires --once")
+	resumeFrom       = flag.Int64("resume-from", 0, "post id to start from when blog has no last id in state. posts newer than it are downloaded")
+	newerThan        = flag.String("newer-than", "", "only posts newer than date (e.g. 2024-01-31) or duration before now (e.g. 30d, 12h)")
+	pageLimit        = flag.Int("page-limit", tumblream.DefaultPageLimit, "number of posts fetched by an api request. max is 50")
+	prefetch         = flag.Bool("prefetch", false, "fetch next page of posts while queueing posts of current page")
+	failOnMissing    = flag.Bool("fail-on-missing", false, "exit if any blog is not found in first cycle")
+	breakerThreshold = flag.Int("breaker-threshold", 5, "number of failed cycles in a row after which blog is skipped for growing number of cycles. 0 disables it")
+	maxPosts         = flag.Int("max-posts", 0, "max number of posts processed per cycle for each blog. rest is left for next cycle. 0 means unlimited")
+	layout           = flag.String("layout", tumblream.LayoutFlat, "layout of files in blog directory. flat, date (<YYYY>/<MM> of post in UTC) or download-date (<YYYY-MM-DD> of saving in local time, which does not support verify and redownload-missing)")
+	storageType      = flag.String("storage", "file", "storage backend of saved files. only file is available")
+	maxIdleConns     = flag.Int("max-idle-conns", 16, "max number of idle connections kept for each host")
+	httpTimeout      = flag.Duration("http-timeout", 30*time.Second, "timeout of api request. image download only limits time to response header by it")
+	downloadTimeout  = flag.Duration("download-timeout", 0, "timeout of each download attempt including body. set it long enough for big videos (e.g. 10m). 0 means unlimited")
+)
+
+// build info stamped by release build like
+// -ldflags "-X main.version=v1.0.0 -X main.commit=abc1234 -X main.date=2026-01-01".
+var (
+	version = "dev"
+	commit  string
+	date    string
+)
+
+// logger is used by main. it is same as logger of tumblream package.
+var logger tumblream.Logger = &tumblream.TextLogger{}
+
+// exit codes of tumblream.
+const (
+	exitOK = 0
+	// exitFailure is used when every download or agent failed.
+	exitFailure = 1
+	// exitConfig is used when flags or config are invalid, or setup failed.
+	exitConfig = 2
+	// exitPartial is used when some of downloads or agents failed.
+	exitPartial = 3
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), `
+Exit status (with --once):
+  %d  success
+  %d  every download or agent failed
+  %d  invalid flags or config, or setup failed
+  %d  some of downloads or agents failed
+`, exitOK, exitFailure, exitConfig, exitPartial)
+}
+
+// fatal logs v by logger and exits with exitConfig.
+func fatal(v ...interface{}) {
+	logger.Log(tumblream.LevelError, "main", "", fmt.Sprint(v...))
+	os.Exit(exitConfig)
+}
+
+// exitCode returns exit status for stats of a cycle in which failed of
+// agents failed. errors of failed agents are counted in total too.
+func exitCode(total *tumblream.Stats, failed, agents int) int {
+	switch {
+	case total.Errors.Load() == 0:
+		return exitOK
+	case failed >= agents:
+		return exitFailure
+	case failed > 0:
+		// other agents succeeded even if they have no new posts.
+		return exitPartial
+	case total.Saved.Load()+total.Skipped.Load() > 0:
+		return exitPartial
+	}
+	return exitFailure
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("tumblream %s (commit: %s, built at: %s)\n", version, orUnknown(commit), orUnknown(date))
+		return
+	}
+
+	level, err := tumblream.ParseLevel(*logLevel)
+	if err != nil {
+		fatal(err)
+	}
+	l, err := tumblream.NewLogger(*logFormat, level)
+	if err != nil {
+		fatal(err)
+	}
+	logger = l
+	tumblream.SetLogger(l)
+
+	config := &Config{}
+	if *configFile != "" {
+		c, err := LoadConfig(*configFile)
+		if err != nil {
+			fatal(err)
+		}
+		config = c
+	}
+	if err := config.ApplyFlags(*configFile == ""); err != nil {
+		fatal(err)
+	}
+	if err := config.Validate(); err != nil {
+		fatal(err)
+	}
+
+	if *concurrency < 1 {
+		fatal("concurrency must be positive: ", *concurrency)
+	}
+
+	if err := tumblream.ValidateSource(*source); err != nil {
+		fatal(err)
+	}
+
+	if err := tumblream.ValidateReblogs(*reblogs); err != nil {
+		fatal(err)
+	}
+
+	if err := tumblream.ValidateLayout(*layout); err != nil {
+		fatal(err)
+	}
+
+	if *pageLimit < 1 {
+		fatal("page-limit must be positive: ", *pageLimit)
+	}
+	if *pageLimit > tumblream.MaxPageLimit {
+		logger.Log(tumblream.LevelWarn, "main", "", fmt.Sprint("page-limit ", *pageLimit, " is over ", tumblream.MaxPageLimit, ". so use ", tumblream.MaxPageLimit))
+		*pageLimit = tumblream.MaxPageLimit
+	}
+
+	if *queueSize < 0 {
+		fatal("queue-size must not be negative: ", *queueSize)
+	}
+
+	if *maxPosts < 0 {
+		fatal("max-posts must not be negative: ", *maxPosts)
+	}
+
+	if *agentConcurrency < 1 {
+		fatal("agent-concurrency must be positive: ", *agentConcurrency)
+	}
+
+	if *maxRetries < 0 {
+		fatal("max-retries must not be negative: ", *maxRetries)
+	}
+
+	if *postHookTimeout < 0 {
+		fatal("post-hook-timeout must not be negative: ", *postHookTimeout)
+	}
+
+	var newerThanTime time.Time
+	if *newerThan != "" {
+		t, err := ParseNewerThan(*newerThan, time.Now())
+		if err != nil {
+			fatal(err)
+		}
+		newerThanTime = t
+	}
+
+	if *jitter < 0 {
+		fatal("jitter must not be negative: ", *jitter)
+	}
+
+	if *httpTimeout <= 0 {
+		fatal("http-timeout must be positive: ", *httpTimeout)
+	}
+	if *cycleTimeout < 0 {
+		fatal("cycle-timeout must not be negative: ", *cycleTimeout)
+	}
+	if *downloadTimeout < 0 {
+		fatal("download-timeout must not be negative: ", *downloadTimeout)
+	}
+
+	baseURL, err := url.Parse(*apiURL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		fatal("invalid api url: ", *apiURL)
+	}
+	if *tumblrHost != "" {
+		// only host is replaced. blog hostname is still in path.
+		if strings.ContainsAny(*tumblrHost, "/?#@") {
+			fatal("invalid tumblr host: ", *tumblrHost)
+		}
+		baseURL.Host = *tumblrHost
+	}
+
+	if *maxIdleConns <= 0 {
+		fatal("max-idle-conns must be positive: ", *maxIdleConns)
+	}
+
+	// api and media requests share a transport, so that connections are
+	// reused across pages and downloads.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConnsPerHost = *maxIdleConns
+	if transport.MaxIdleConns < *maxIdleConns {
+		transport.MaxIdleConns = *maxIdleConns
+	}
+	transport.ResponseHeaderTimeout = *httpTimeout
+	if *proxy != "" {
+		proxyURL, err := parseProxy(*proxy)
+		if err != nil {
+			fatal(err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	// timeouts are set to agents and saver as deadline of context, so that
+	// shutdown cancels requests as well.
+	httpClient := &http.Client{Transport: transport}
+
+	var oauth *tumblream.OAuth
+	if *oauthConsumerSec != "" || *oauthToken != "" || *oauthSecret != "" {
+		oauth = &tumblream.OAuth{
+			ConsumerKey:    *oauthConsumerKey,
+			ConsumerSecret: *oauthConsumerSec,
+			Token:          *oauthToken,
+			TokenSecret:    *oauthSecret,
+		}
+		if oauth.ConsumerKey == "" {
+			oauth.ConsumerKey = config.ApiKey
+		}
+		if err := oauth.Validate(); err != nil {
+			fatal(err)
+		}
+	}
+
+	stateList := strings.Split(*states, ",")
+	if err := tumblream.ValidateStates(stateList); err != nil {
+		fatal(err)
+	}
+	for _, state := range stateList {
+		if state != tumblream.StatePublished && oauth == nil {
+			fatal("state ", state, " requires OAuth")
+		}
+	}
+
+	if *minWidth < 0 || *minHeight < 0 {
+		fatal("min-width and min-height must not be negative")
+	}
+
+	// posts in window of ids are fetched in one-shot repair mode.
+	window := *afterId != 0 || *beforeId != 0
+	if window {
+		if !*once {
+			fatal("after-id and before-id require --once")
+		}
+		if *source == tumblream.SourceLikes {
+			fatal("after-id and before-id are not supported with likes")
+		}
+		if *afterId < 0 || *beforeId < 0 {
+			fatal("after-id and before-id must be positive post ids")
+		}
+		if *beforeId != 0 && *afterId >= *beforeId {
+			fatal("after-id must be less than before-id")
+		}
+	}
+
+	if *verify && !*once {
+		fatal("verify requires --once")
+	}
+
+	// files saved in other days are not found by key of today.
+	if *layout == tumblream.LayoutDownloadDate && (*verify || *redownload) {
+		fatal("verify and redownload-missing are not supported with download-date layout")
+	}
+
+	var sizeList []string
+	if *sizes != "" {
+		sizeList = strings.Split(*sizes, ",")
+		for _, s := range sizeList {
+			if err := tumblream.ValidateSize(s); err != nil {
+				fatal(err)
+			}
+		}
+	}
+
+	var tagList []string
+	if *tags != "" {
+		tagList = strings.Split(*tags, ",")
+	}
+
+	var extList []string
+	if *exts != "" {
+		extList = strings.Split(*exts, ",")
+	}
+
+	newAgent := func(blog BlogConfig) *tumblream.Agent {
+		agent := &tumblream.Agent{Hostname: blog.Hostname, ApiKey: blog.ApiKey, Size: blog.Size, Types: blog.Types, Tags: tagList}
+		agent.BaseURL = baseURL.String()
+		agent.Timeout = *httpTimeout
+		agent.Client = &tumblream.Client{HTTPClient: httpClient, UserAgent: *userAgent, OAuth: oauth}
+		agent.MaxPosts = *maxPosts
+		agent.Reblogs = *reblogs
+		agent.Source = *source
+		agent.States = stateList
+		agent.Sizes = sizeList
+		agent.MinWidth = *minWidth
+		agent.MinHeight = *minHeight
+		agent.Extensions = extList
+		agent.Prefetch = *prefetch
+		agent.PageLimit = *pageLimit
+		agent.NewerThan = newerThanTime
+		agent.Breaker = &tumblream.Breaker{Threshold: *breakerThreshold}
+		if window {
+			agent.AfterId = *afterId
+			agent.BeforeId = *beforeId
+			agent.FetchAll = true
+		}
+		if *verify {
+			agent.FetchAll = true
+		}
+		return agent
+	}
+
+	agents := []*tumblream.Agent{}
+	resumeFromIds := map[string]int64{}
+	for _, blog := range config.Blogs {
+		resumeFromIds[blog.Hostname] = blog.ResumeFrom
+		agents = append(agents, newAgent(blog))
+	}
+
+	if *printUrls {
+		os.Exit(printURLs(agents))
+	}
+
+	absDir, err := filepath.Abs(config.Dir)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *showStatus {
+		if err := printStatus(os.Stdout, absDir, config.Blogs); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	if err := checkWritable(absDir); err != nil {
+		fatal("output directory is not writable: ", err)
+	}
+
+	state, err := tumblream.LoadState(filepath.Join(absDir, ".tumblream-state.json"))
+	if err != nil {
+		fatal(err)
+	}
+
+	var storage tumblream.Storage
+	switch *storageType {
+	case "file":
+		storage = tumblream.NewFileStorage(absDir)
+	default:
+		fatal("unknown storage: ", *storageType)
+	}
+	fileStorage, _ := storage.(*tumblream.FileStorage)
+
+	saver := tumblream.NewSaver(storage, *concurrency, *maxRetries, *queueSize)
+	saver.Client = &tumblream.Client{HTTPClient: httpClient, UserAgent: *userAgent}
+	saver.Metadata = *metadata
+	saver.DryRun = *dryRun
+	saver.Verbose = *verboseStats
+	saver.MaxFileSize = int64(*maxFileSize)
+	saver.Verify = *verify
+	if *retryBackoff < 0 {
+		fatal("retry-backoff must not be negative: ", *retryBackoff)
+	}
+	saver.RetryBackoff = *retryBackoff
+	if *thumbnails < 0 {
+		fatal("thumbnails must not be negative: ", *thumbnails)
+	}
+	if _, ok := storage.(tumblream.OpenStorage); *thumbnails > 0 && !ok {
+		fatal("storage ", *storageType, " does not support thumbnails")
+	}
+	saver.ThumbnailSize = *thumbnails
+	saver.Timeout = *downloadTimeout
+	if *minFree > 0 {
+		fss, ok := storage.(tumblream.FreeSpaceStorage)
+		if !ok {
+			fatal("storage ", *storageType, " does not support min-free")
+		}
+		if _, err := fss.FreeSpace(); err != nil {
+			fatal("min-free is not supported: ", err)
+		}
+		saver.MinFree = int64(*minFree)
+	}
+	var budget *tumblream.ByteBudget
+	if *maxBytes > 0 {
+		budget = &tumblream.ByteBudget{Max: int64(*maxBytes)}
+		saver.Budget = budget
+	}
+	if *rateLimit > 0 {
+		saver.Limiter = tumblream.NewRateLimiter(int64(*rateLimit))
+	}
+	saver.Layout = *layout
+	if *filenameTemplate != "" {
+		tmpl, err := template.New("filename").Parse(*filenameTemplate)
+		if err != nil {
+			fatal("invalid filename-template: ", err)
+		}
+		if err := tumblream.ValidateFilenameTemplate(tmpl); err != nil {
+			fatal("invalid filename-template: ", err)
+		}
+		saver.FilenameTemplate = tmpl
+	}
+
+	// ctx is canceled by SIGINT or SIGTERM. queued downloads are not
+	// canceled by it, and default handler is restored so that second signal
+	// kills process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if *postHook != "" && fileStorage == nil {
+		fatal("post-hook requires file storage")
+	}
+	saver.OnSaved = func(_ context.Context, item tumblream.Item, result *tumblream.Result) {
+		state.AddSaved(item.Hostname)
+		if *postHook != "" {
+			// hooks are killed at shutdown, so that hung one does not block
+			// waiting for queued downloads.
+			runHook(ctx, *postHook, *postHookTimeout, fileStorage.Path(result.Key), item)
+		}
+	}
+	if *dedupe {
+		hashes, err := tumblream.LoadHashStore(filepath.Join(absDir, ".hashes"))
+		if err != nil {
+			fatal(err)
+		}
+		saver.Hashes = hashes
+	}
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", tumblream.MetricsHandler())
+		go func() {
+			fatal("metrics server: ", http.ListenAndServe(*metricsAddr, mux))
+		}()
+	}
+
+	downloaded, err := tumblream.LoadURLStore(filepath.Join(absDir, ".downloaded"))
+	if err != nil {
+		fatal(err)
+	}
+	saver.Downloaded = downloaded
+
+	dead, err := tumblream.LoadDeadURLStore(filepath.Join(absDir, ".dead"), *deadTTL)
+	if err != nil {
+		fatal(err)
+	}
+	saver.Dead = dead
+
+	if *manifest != "" {
+		m, err := tumblream.OpenManifest(*manifest)
+		if err != nil {
+			fatal(err)
+		}
+		saver.Manifest = m
+	}
+
+	if *retryFailures && *failuresFile == "" {
+		fatal("retry-failures requires failures-file")
+	}
+
+	var retryItems []tumblream.Item
+	if *failuresFile != "" {
+		if *retryFailures {
+			retryItems, err = tumblream.ReadFailures(*failuresFile)
+			if err != nil {
+				fatal(err)
+			}
+			// items which fail again are appended to new file.
+			if err := os.Remove(*failuresFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				fatal(err)
+			}
+		}
+		failures, err := tumblream.OpenFailureLog(*failuresFile)
+		if err != nil {
+			fatal(err)
+		}
+		saver.OnFailure = func(item tumblream.Item, saveErr error) {
+			if err := failures.Add(item, saveErr); err != nil {
+				logger.Log(tumblream.LevelError, "main", "", fmt.Sprint("failed to write failures file: ", err))
+			}
+		}
+	}
+
+	saverDone := make(chan struct{})
+	go func() {
+		saver.Run(context.Background())
+		close(saverDone)
+	}()
+
+	// retried items are counted in total of first cycle.
+	var retryStats *tumblream.Stats
+	if len(retryItems) > 0 {
+		logger.Log(tumblream.LevelInfo, "main", "", fmt.Sprint("retry ", len(retryItems), " failed downloads"))
+		retryStats = &tumblream.Stats{}
+		queueItems(ctx, saver, retryItems, retryStats)
+	}
+
+	var onEvent func(tumblream.Event)
+	if *eventsFile != "" {
+		file, err := os.OpenFile(*eventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			fatal(err)
+		}
+		events := tumblream.NewEventWriter(file)
+		onEvent = func(event tumblream.Event) {
+			if err := events.Write(event); err != nil {
+				logger.Log(tumblream.LevelError, "main", "", fmt.Sprint("failed to write event: ", err))
+			}
+		}
+		saver.OnEvent = onEvent
+	}
+
+	// setupAgent connects agent to saver and state, and seeds last id of it.
+	setupAgent := func(agent *tumblream.Agent, resumeFrom int64) {
+		agent.OnEvent = onEvent
+		// urls saved before are checked by existence of file with
+		// --redownload-missing.
+		if !*redownload && !*verify {
+			agent.Downloaded = downloaded
+			// sidecar of download-date layout is under directory of the day
+			// it is saved, so it is not found later.
+			if *metadata && *layout != tumblream.LayoutDownloadDate {
+				// sidecar is kept even if file is moved to elsewhere.
+				agent.Skip = saver.HasMetadata
+			}
+		}
+		agent.Dead = dead
+		agent.Budget = budget
+		if saver.MinFree > 0 {
+			agent.LowSpace = saver.LowSpace
+		}
+		if window || *verify {
+			// all posts are walked regardless of last id.
+			return
+		}
+		agent.SetLastId(state.LastId(agent.Hostname))
+		if agent.LastId() == 0 && resumeFrom != 0 {
+			agent.SetLastId(resumeFrom)
+		}
+		if agent.LastId() != 0 {
+			agent.Log("resume from last id ", agent.LastId())
+		}
+	}
+	for _, agent := range agents {
+		setupAgent(agent, resumeFromIds[agent.Hostname])
+	}
+
+	if len(agents) == 0 {
+		fatal("empty agents")
+	}
+
+	if *once {
+		result := runCycle(ctx, agents, saver, state)
+		checkMissing(result.missing)
+		// wait for queued downloads, not only for agents.
+		saver.Close()
+		<-saverDone
+		flushState(state)
+		if *verify {
+			logger.Log(tumblream.LevelInfo, "verify", "", fmt.Sprint("files: ", &saver.VerifyStats))
+		}
+		os.Exit(exitCode(summarize(agents, retryStats), result.failed, len(agents)))
+	}
+
+	logger.Log(tumblream.LevelInfo, "main", "", fmt.Sprint("poll every ", config.Interval.Duration))
+	timer := time.NewTimer(0)
+
+	// process is regarded as wedged when no cycle is completed within two
+	// intervals.
+	h := newHealth(2 * (config.Interval.Duration + *jitter))
+	if *healthAddr != "" {
+		go func() {
+			fatal("health server: ", http.ListenAndServe(*healthAddr, h.handler()))
+		}()
+	}
+
+	// blogs are reloaded from config and hostnames file by SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	first := true
+	for {
+		select {
+		case <-hup:
+			c, err := reloadConfig()
+			if err != nil {
+				logger.Log(tumblream.LevelError, "main", "", fmt.Sprint("failed to reload config: ", err, ". keep current blogs"))
+				continue
+			}
+			agents = reloadAgents(agents, c.Blogs, func(blog BlogConfig) *tumblream.Agent {
+				agent := newAgent(blog)
+				setupAgent(agent, blog.ResumeFrom)
+				return agent
+			})
+		case <-ctx.Done():
+			logger.Log(tumblream.LevelInfo, "main", "", fmt.Sprint("shutting down: ", ctx.Err(), ". wait for queued downloads (send signal again to abort)"))
+			saver.Close()
+			<-saverDone
+			flushState(state)
+			return
+		case <-timer.C:
+			result := runCycle(ctx, agents, saver, state)
+			if first {
+				checkMissing(result.missing)
+				first = false
+			}
+			// counts of cycle are final after its downloads finish, and
+			// budget of next cycle is not charged by them.
+			if err := waitDownloads(ctx, agents, retryStats); err != nil {
+				// shutting down.
+				continue
+			}
+			summarize(agents, retryStats)
+			retryStats = nil
+			// process is not healthy while every agent keeps failing.
+			if result.succeeded > 0 {
+				h.CycleDone()
+			} else {
+				logger.Log(tumblream.LevelWarn, "main", "", "no agents succeeded in this cycle")
+			}
+			next := config.Interval.Duration
+			var j time.Duration
+			if *jitter > 0 {
+				j = time.Duration(rand.Int63n(int64(*jitter)))
+				next += j
+			}
+			logger.Log(tumblream.LevelInfo, "main", "", fmt.Sprint("next poll in ", next, " (jitter ", j, ") at ", time.Now().Add(next).Format(time.RFC3339)))
+			timer.Reset(next)
+		}
+	}
+}
+
+// reloadConfig loads config and applies flags in same way as startup.
+func reloadConfig() (*Config, error) {
+	config := &Config{}
+	if *configFile != "" {
+		c, err := LoadConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		config = c
+	}
+	if err := config.ApplyFlags(*configFile == ""); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// reloadAgents returns agents of blogs. agents of blogs which are kept are
+// reused with their last id, and their api key, size and types are updated.
+// agents of new blogs are created by newAgent.
+func reloadAgents(agents []*tumblream.Agent, blogs []BlogConfig, newAgent func(BlogConfig) *tumblream.Agent) []*tumblream.Agent {
+	current := map[string]*tumblream.Agent{}
+	for _, agent := range agents {
+		current[agent.Hostname] = agent
+	}
+
+	var added []string
+	reloaded := make([]*tumblream.Agent, 0, len(blogs))
+	for _, blog := range blogs {
+		agent, ok := current[blog.Hostname]
+		if ok {
+			agent.ApiKey = blog.ApiKey
+			agent.Size = blog.Size
+			agent.Types = blog.Types
+			delete(current, blog.Hostname)
+		} else {
+			agent = newAgent(blog)
+			added = append(added, blog.Hostname)
+		}
+		reloaded = append(reloaded, agent)
+	}
+
+	var removed []string
+	for _, agent := range agents {
+		if _, ok := current[agent.Hostname]; ok {
+			removed = append(removed, agent.Hostname)
+		}
+	}
+
+	logger.Log(tumblream.LevelInfo, "main", "", fmt.Sprint("reloaded config. added: [", strings.Join(added, ", "), "] removed: [", strings.Join(removed, ", "), "]"))
+	return reloaded
+}
+
+// checkWritable creates dir if it does not exist and tries to write a file in it.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".tumblream-write-test-")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
+
+// parseProxy parses url of http or socks5 proxy.
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %s", s, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy %s: unsupported scheme %q", s, u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %s: empty host", s)
+	}
+	return u, nil
+}
+
+// cycleResult is outcome of agents in a cycle.
+type cycleResult struct {
+	// missing is hostnames of blogs which are not found.
+	missing []string
+	// failed is number of agents which failed.
+	failed int
+	// succeeded is number of agents which succeeded. agents skipped by
+	// breaker or cycle timeout are neither of them.
+	succeeded int
+}
+
+// runCycle runs all agents and waits for them. downloads queued by agents may
+// be still in progress when it returns. waitDownloads waits for them.
+func runCycle(ctx context.Context, agents []*tumblream.Agent, saver *tumblream.Saver, state *tumblream.State) *cycleResult {
+	saver.Budget.Reset()
+	// agents still running at deadline of cycle are canceled, so that stuck
+	// one does not block others in next cycles.
+	cycleCtx := ctx
+	if *cycleTimeout > 0 {
+		var cancel context.CancelFunc
+		cycleCtx, cancel = context.WithTimeout(ctx, *cycleTimeout)
+		defer cancel()
+	}
+	// sem limits number of agents paginating at once.
+	sem := make(chan struct{}, *agentConcurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	result := &cycleResult{}
+	for _, agent := range agents {
+		wg.Add(1)
+		go func(agent *tumblream.Agent) {
+			defer wg.Done()
+			agent.Reset()
+			if !agent.Breaker.Allow() {
+				agent.Debug("circuit breaker is open. so skip this cycle.")
+				return
+			}
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-cycleCtx.Done():
+				if ctx.Err() == nil {
+					agent.Warn("canceled by cycle timeout ", *cycleTimeout, " before it runs")
+				}
+				return
+			}
+			if err := agent.RunWithRetry(cycleCtx, saver.Queue()); err != nil {
+				agent.Stats().Errors.Add(1)
+				mu.Lock()
+				result.failed++
+				mu.Unlock()
+				if ctx.Err() == nil && cycleCtx.Err() != nil {
+					agent.Error("canceled by cycle timeout ", *cycleTimeout, ". agent will retry next cycle")
+				}
+				if ctx.Err() == nil {
+					if skip := agent.Breaker.Failure(); skip > 0 {
+						agent.Warn("circuit breaker is open. skip next ", skip, " cycles")
+					}
+				}
+				if cycleCtx.Err() != nil {
+					// logged above when it is canceled by cycle timeout.
+					return
+				}
+				switch tumblream.Categorize(err) {
+				case tumblream.CategoryNotFound:
+					agent.Error("blog is not found or unavailable (", err, "). will keep retrying next cycle")
+					mu.Lock()
+					result.missing = append(result.missing, agent.Hostname)
+					mu.Unlock()
+				case tumblream.CategoryUnauthorized:
+					agent.Error("not authorized (", err, "). check api key or OAuth credentials")
+				default:
+					agent.Error("got err ", err, ". agent will retry next cycle")
+				}
+				return
+			}
+			mu.Lock()
+			result.succeeded++
+			mu.Unlock()
+			if agent.Breaker.Success() {
+				agent.Log("circuit breaker is closed")
+			}
+			if *dryRun {
+				// real run afterward should fetch everything.
+				return
+			}
+			if agent.AfterId != 0 || agent.BeforeId != 0 || *verify {
+				// repair does not move last id.
+				return
+			}
+			if err := state.SetLastId(agent.Hostname, agent.LastId()); err != nil {
+				agent.Error("failed to save state: ", err)
+			}
+		}(agent)
+	}
+	wg.Wait()
+	return result
+}
+
+// checkMissing aborts when --fail-on-missing is set and some blogs are not
+// found.
+func checkMissing(missing []string) {
+	if *failOnMissing && len(missing) > 0 {
+		fatal("blogs are not found: ", strings.Join(missing, ", "))
+	}
+}
+
+// flushState writes counters of state which are not written yet.
+func flushState(state *tumblream.State) {
+	if *dryRun {
+		return
+	}
+	if err := state.Flush(); err != nil {
+		logger.Log(tumblream.LevelError, "main", "", fmt.Sprint("failed to save state: ", err))
+	}
+}
+
+// queueItems queues items to saver until ctx is done. results of them are
+// counted in stats.
+func queueItems(ctx context.Context, saver *tumblream.Saver, items []tumblream.Item, stats *tumblream.Stats) {
+	for _, item := range items {
+		item.Stats = stats
+		select {
+		case saver.Queue() <- item:
+			stats.Queued.Add(1)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// waitDownloads waits for items queued by agents and retries in current
+// cycle. retries may be nil.
+func waitDownloads(ctx context.Context, agents []*tumblream.Agent, retries *tumblream.Stats) error {
+	if retries != nil {
+		if err := retries.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	for _, agent := range agents {
+		if err := agent.Stats().Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summarize logs stats of each agent and retried items, and returns total of
+// them. blogs without new posts or errors are omitted with --summary-only-new.
+// retries is nil when no items are retried.
+func summarize(agents []*tumblream.Agent, retries *tumblream.Stats) *tumblream.Stats {
+	total := &tumblream.Stats{}
+	if retries != nil {
+		total.Merge(retries)
+		logger.Log(tumblream.LevelInfo, "summary", "", fmt.Sprint("retry: ", retries))
+	}
+	var active int
+	for _, agent := range agents {
+		stats := agent.Stats()
+		total.Merge(stats)
+		if stats.Posts.Load() == 0 && stats.Errors.Load() == 0 {
+			if *summaryOnlyNew {
+				continue
+			}
+		} else {
+			active++
+		}
+		agent.Log("summary: ", stats)
+	}
+	logger.Log(tumblream.LevelInfo, "summary", "", fmt.Sprint("total: ", total, " blogs=", active, "/", len(agents)))
+	if *dryRun {
+		logger.Log(tumblream.LevelInfo, "dry-run", "", fmt.Sprint(total.Queued.Load(), " urls would be saved"))
+	}
+	return total
+}
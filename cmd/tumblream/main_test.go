@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/soh335/tumblream"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name                   string
+		saved, skipped, errors int64
+		failed, agents         int
+		want                   int
+	}{
+		{name: "no errors", saved: 1, agents: 2, want: exitOK},
+		{name: "no new posts", agents: 2, want: exitOK},
+		{name: "some downloads failed", saved: 1, errors: 1, agents: 1, want: exitPartial},
+		{name: "some downloads failed and others exist", skipped: 1, errors: 1, agents: 1, want: exitPartial},
+		{name: "every download failed", errors: 2, agents: 1, want: exitFailure},
+		{name: "blog not found and other has no new posts", errors: 1, failed: 1, agents: 2, want: exitPartial},
+		{name: "every agent failed", errors: 2, failed: 2, agents: 2, want: exitFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			total := &tumblream.Stats{}
+			total.Saved.Store(tt.saved)
+			total.Skipped.Store(tt.skipped)
+			total.Errors.Store(tt.errors)
+			if got := exitCode(total, tt.failed, tt.agents); got != tt.want {
+				t.Errorf("exitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunHookTimeout(t *testing.T) {
+	start := time.Now()
+	runHook(context.Background(), "sleep 10", 50*time.Millisecond, "file", tumblream.Item{})
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("hook ran %s over timeout", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	runHook(ctx, "sleep 10", 0, "file", tumblream.Item{})
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("hook ran %s after shutdown", d)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/soh335/tumblream"
+)
+
+// printURLs runs agents over all posts and prints urls found by them to
+// stdout line by line, and returns exit status. nothing is saved.
+func printURLs(agents []*tumblream.Agent) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	q := make(chan tumblream.Item)
+	done := make(chan error)
+	go func() {
+		w := bufio.NewWriter(os.Stdout)
+		for item := range q {
+			w.WriteString(item.Url + "\n")
+		}
+		done <- w.Flush()
+	}()
+
+	var errs int
+	for _, agent := range agents {
+		agent.FetchAll = true
+		agent.Reset()
+		if err := agent.RunWithRetry(ctx, q); err != nil {
+			agent.Error("got err ", err)
+			errs++
+		}
+	}
+	close(q)
+	if err := <-done; err != nil {
+		logger.Log(tumblream.LevelError, "main", "", fmt.Sprint("failed to write urls: ", err))
+		return exitFailure
+	}
+	switch errs {
+	case 0:
+		return exitOK
+	case len(agents):
+		return exitFailure
+	}
+	return exitPartial
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/soh335/tumblream"
+)
+
+// printStatus prints state of blogs in dir. it does not write anything.
+func printStatus(w io.Writer, dir string, blogs []BlogConfig) error {
+	state, err := tumblream.LoadState(filepath.Join(dir, ".tumblream-state.json"))
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOSTNAME\tLAST ID\tLAST FETCHED\tSAVED")
+	for _, blog := range blogs {
+		b := state.Blog(blog.Hostname)
+		lastFetched := "never"
+		if b.LastFetched != 0 {
+			lastFetched = time.Unix(b.LastFetched, 0).Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\n", blog.Hostname, b.LastId, lastFetched, b.Saved)
+	}
+	return tw.Flush()
+}
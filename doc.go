@@ -0,0 +1,5 @@
+// Package tumblream fetches posts of tumblr blogs and saves their photos and
+// videos. Agent paginates posts of a blog and queues media to Saver, which
+// downloads them into Storage. command tumblream in cmd/tumblream polls blogs
+// with them.
+package tumblream
@@ -0,0 +1,65 @@
+package tumblream
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// types of Event.
+const (
+	EventPostDiscovered    = "post_discovered"
+	EventDownloadStarted   = "download_started"
+	EventDownloadCompleted = "download_completed"
+	EventDownloadFailed    = "download_failed"
+)
+
+// Event is emitted by agent and saver through their OnEvent. fields which are
+// not related to Type are empty.
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Blog    string    `json:"blog"`
+	PostId  int64     `json:"post_id,omitempty"`
+	PostUrl string    `json:"post_url,omitempty"`
+	Url     string    `json:"url,omitempty"`
+	// Key and Size are set for EventDownloadCompleted.
+	Key  string `json:"key,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	// Error is set for EventDownloadFailed.
+	Error string `json:"error,omitempty"`
+}
+
+func itemEvent(typ string, item Item) Event {
+	return Event{
+		Type:    typ,
+		Time:    time.Now(),
+		Blog:    item.Hostname,
+		PostId:  item.PostId,
+		PostUrl: item.PostUrl,
+		Url:     item.Url,
+	}
+}
+
+// EventWriter writes events as json per line. it is safe for concurrent use.
+type EventWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewEventWriter(w io.Writer) *EventWriter {
+	return &EventWriter{w: w}
+}
+
+func (e *EventWriter) Write(event Event) error {
+	data, err := json.Marshal(&event)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package tumblream
+
+import "syscall"
+
+// freeSpace returns bytes available to unprivileged user in filesystem of
+// dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,130 @@
+package tumblream
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger is used by Log methods of components.
+var logger Logger = &TextLogger{}
+
+// Level is severity of log line. zero value is LevelInfo.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %s", s)
+}
+
+func (l Level) String() string {
+	switch {
+	case l <= LevelDebug:
+		return "debug"
+	case l < LevelWarn:
+		return "info"
+	case l < LevelError:
+		return "warn"
+	}
+	return "error"
+}
+
+// Logger writes a log line of component. hostname is empty when the line is
+// not related to a blog.
+type Logger interface {
+	Log(level Level, component string, hostname string, msg string)
+}
+
+// SetLogger sets logger used by Log methods of components.
+func SetLogger(l Logger) {
+	logger = l
+}
+
+// NewLogger returns logger of format which drops lines less severe than level.
+func NewLogger(format string, level Level) (Logger, error) {
+	switch format {
+	case "text":
+		return &TextLogger{Level: level}, nil
+	case "json":
+		return &JSONLogger{Level: level, w: os.Stderr}, nil
+	}
+	return nil, fmt.Errorf("unknown log format: %s", format)
+}
+
+// TextLogger writes human readable line like "[agent][hostname] msg". level
+// other than info is written before msg like "warn: msg".
+type TextLogger struct {
+	Level Level
+}
+
+func (l *TextLogger) Log(level Level, component string, hostname string, msg string) {
+	if level < l.Level {
+		return
+	}
+	if level != LevelInfo {
+		msg = level.String() + ": " + msg
+	}
+	if hostname == "" {
+		log.Println(fmt.Sprintf("[%s]", component), msg)
+		return
+	}
+	log.Println(fmt.Sprintf("[%s][%s]", component, hostname), msg)
+}
+
+// JSONLogger writes a json object per line.
+type JSONLogger struct {
+	Level Level
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type jsonLogLine struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Component string `json:"component"`
+	Hostname  string `json:"hostname,omitempty"`
+	Message   string `json:"message"`
+}
+
+func (l *JSONLogger) Log(level Level, component string, hostname string, msg string) {
+	if level < l.Level {
+		return
+	}
+	data, err := json.Marshal(&jsonLogLine{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		Level:     level.String(),
+		Component: component,
+		Hostname:  hostname,
+		Message:   msg,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(append(data, '\n'))
+}
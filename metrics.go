@@ -0,0 +1,68 @@
+package tumblream
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metrics is updated by agents and saver, and exposed by --metrics-addr.
+var metrics = NewMetrics()
+
+// Metrics is counters exposed in prometheus text format.
+type Metrics struct {
+	PostsFetched     atomic.Int64
+	ImagesDownloaded atomic.Int64
+	BytesWritten     atomic.Int64
+	DownloadErrors   atomic.Int64
+
+	mu      sync.Mutex
+	lastIds map[string]int64
+}
+
+// MetricsHandler returns handler which serves metrics of agents and savers.
+func MetricsHandler() http.Handler {
+	return metrics
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{lastIds: map[string]int64{}}
+}
+
+func (m *Metrics) SetLastId(hostname string, lastId int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastIds[hostname] = lastId
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP writes metrics in prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	counter := func(name string, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("tumblream_posts_fetched_total", "Total number of fetched posts.", m.PostsFetched.Load())
+	counter("tumblream_images_downloaded_total", "Total number of downloaded images.", m.ImagesDownloaded.Load())
+	counter("tumblream_bytes_written_total", "Total bytes written to files.", m.BytesWritten.Load())
+	counter("tumblream_download_errors_total", "Total number of failed downloads.", m.DownloadErrors.Load())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hostnames := make([]string, 0, len(m.lastIds))
+	for hostname := range m.lastIds {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	fmt.Fprint(w, "# HELP tumblream_last_id Last post id of blog.\n# TYPE tumblream_last_id gauge\n")
+	for _, hostname := range hostnames {
+		fmt.Fprintf(w, "tumblream_last_id{blog=\"%s\"} %d\n", labelReplacer.Replace(hostname), m.lastIds[hostname])
+	}
+}
@@ -0,0 +1,89 @@
+package tumblream
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OAuth is credentials of OAuth 1.0a. requests are signed by HMAC-SHA1 with
+// them, so that blogs which are not visible by api key can be fetched.
+type OAuth struct {
+	ConsumerKey    string
+	ConsumerSecret string
+	Token          string
+	TokenSecret    string
+}
+
+func (o *OAuth) Validate() error {
+	if o.ConsumerKey == "" || o.ConsumerSecret == "" || o.Token == "" || o.TokenSecret == "" {
+		return errors.New("oauth requires consumer key, consumer secret, token and token secret")
+	}
+	return nil
+}
+
+// Sign sets Authorization header of req. body of req is not signed, so it is
+// only for GET request.
+func (o *OAuth) Sign(req *http.Request) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	oauthParams := map[string]string{
+		"oauth_consumer_key":     o.ConsumerKey,
+		"oauth_nonce":            hex.EncodeToString(nonce),
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        strconv.FormatInt(time.Now().Unix(), 10),
+		"oauth_token":            o.Token,
+		"oauth_version":          "1.0",
+	}
+
+	var params []string
+	for k, vs := range req.URL.Query() {
+		for _, v := range vs {
+			params = append(params, percentEncode(k)+"="+percentEncode(v))
+		}
+	}
+	for k, v := range oauthParams {
+		params = append(params, percentEncode(k)+"="+percentEncode(v))
+	}
+	sort.Strings(params)
+
+	baseURL := strings.ToLower(req.URL.Scheme) + "://" + strings.ToLower(req.URL.Host) + req.URL.EscapedPath()
+	base := req.Method + "&" + percentEncode(baseURL) + "&" + percentEncode(strings.Join(params, "&"))
+
+	mac := hmac.New(sha1.New, []byte(percentEncode(o.ConsumerSecret)+"&"+percentEncode(o.TokenSecret)))
+	mac.Write([]byte(base))
+	oauthParams["oauth_signature"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	var header []string
+	for k, v := range oauthParams {
+		header = append(header, percentEncode(k)+`="`+percentEncode(v)+`"`)
+	}
+	sort.Strings(header)
+	req.Header.Set("Authorization", "OAuth "+strings.Join(header, ", "))
+	return nil
+}
+
+// percentEncode encodes s as RFC 3986, which OAuth 1.0a requires.
+func percentEncode(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return b.String()
+}
@@ -0,0 +1,114 @@
+package tumblream
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is token bucket which limits bytes per second. it is shared by
+// all workers of saver, so that aggregate throughput is limited.
+type RateLimiter struct {
+	rate  float64
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns RateLimiter which allows bytesPerSec bytes per second.
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	burst := int(bytesPerSec)
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait waits until n bytes are allowed. tokens are taken in advance, so that
+// concurrent callers wait in turn.
+func (l *RateLimiter) Wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+	return sleep(ctx, d)
+}
+
+// Reader returns reader whose reads are limited by l. r is returned as is
+// when l is nil.
+func (l *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, l: l}
+}
+
+type rateLimitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.l.burst {
+		p = p[:r.l.burst]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.l.Wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// ByteBudget is max bytes saved in a cycle. it is shared by agents and saver.
+// downloads already queued are finished after it is exceeded, so bytes of a
+// cycle may be over Max by them.
+type ByteBudget struct {
+	Max  int64
+	used atomic.Int64
+}
+
+// Add counts n bytes saved. it does nothing when b is nil.
+func (b *ByteBudget) Add(n int64) {
+	if b == nil {
+		return
+	}
+	b.used.Add(n)
+}
+
+// Exceeded reports whether saved bytes reached Max. it is false when b is nil.
+func (b *ByteBudget) Exceeded() bool {
+	return b != nil && b.used.Load() >= b.Max
+}
+
+// Reset clears saved bytes for new cycle.
+func (b *ByteBudget) Reset() {
+	if b == nil {
+		return
+	}
+	b.used.Store(0)
+}
@@ -0,0 +1,985 @@
+package tumblream
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// Item is a photo to be saved.
+type Item struct {
+	Hostname string
+	Url      string
+	Index    int
+	// Size is size of photo when several sizes are saved. it is appended to
+	// filename, so that sizes do not collide.
+	Size      string
+	PostId    int64
+	PostUrl   string
+	Timestamp int64
+
+	// Stats is counters of agent which queued the item.
+	Stats *Stats
+}
+
+// Stats is counters of a cycle. it is updated concurrently by agent and saver.
+type Stats struct {
+	Posts   atomic.Int64
+	Queued  atomic.Int64
+	Saved   atomic.Int64
+	Skipped atomic.Int64
+	Errors  atomic.Int64
+
+	mu sync.Mutex
+	// finished is items finished by Saver. changed is closed when it grows.
+	finished int64
+	changed  chan struct{}
+}
+
+// Merge adds counters of o to s.
+func (s *Stats) Merge(o *Stats) {
+	s.Posts.Add(o.Posts.Load())
+	s.Queued.Add(o.Queued.Load())
+	s.Saved.Add(o.Saved.Load())
+	s.Skipped.Add(o.Skipped.Load())
+	s.Errors.Add(o.Errors.Load())
+}
+
+// finish counts item finished by Saver.
+func (s *Stats) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished++
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// Wait blocks until as many items as Queued are finished by Saver, so that
+// counters are final. it returns error of ctx when ctx is done before it.
+func (s *Stats) Wait(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if s.finished >= s.Queued.Load() {
+			s.mu.Unlock()
+			return nil
+		}
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("posts=%d queued=%d saved=%d skipped=%d errors=%d",
+		s.Posts.Load(), s.Queued.Load(), s.Saved.Load(), s.Skipped.Load(), s.Errors.Load())
+}
+
+// Metadata is written as sidecar json of saved file.
+type Metadata struct {
+	PostId    int64  `json:"post_id"`
+	Blog      string `json:"blog"`
+	PostUrl   string `json:"post_url"`
+	Timestamp int64  `json:"timestamp"`
+	Url       string `json:"url"`
+}
+
+type Saver struct {
+	// Client is used to download. zero Client is used when it is nil.
+	Client      *Client
+	Storage     Storage
+	Concurrency int
+	MaxRetries  int
+	Metadata    bool
+	Hashes      *HashStore
+	DryRun      bool
+	Verbose     bool
+	MaxFileSize int64
+	// Verify checks size of existing files with remote one, and downloads
+	// missing or mismatched files again. results are counted in VerifyStats.
+	Verify      bool
+	VerifyStats VerifyStats
+	// ThumbnailSize is long side of thumbnails of saved images in pixel.
+	// thumbnails are written under ThumbnailDir of blog. 0 means none.
+	ThumbnailSize int
+	// RetryBackoff is wait before first retry of network errors and 5xx.
+	// it is doubled by each attempt. DefaultRetryBackoff is used when it is 0.
+	RetryBackoff time.Duration
+	// Timeout limits time of a download attempt including reading body. 0
+	// means unlimited.
+	Timeout time.Duration
+	// MinFree is bytes of free space of storage kept. items are not saved
+	// when free space is under it. 0 means unlimited.
+	MinFree    int64
+	Downloaded *URLStore
+	// Dead records urls which responded 404 or 410.
+	Dead     *DeadURLStore
+	Manifest *Manifest
+	Layout   string
+	// OnEvent is called with events of downloads. EventDownloadStarted is
+	// emitted for each attempt.
+	OnEvent func(Event)
+	// OnSaved is called with item which is newly saved. it is called by
+	// worker, so next item of the worker waits for it.
+	OnSaved func(ctx context.Context, item Item, result *Result)
+	// OnFailure is called with item whose save failed after retries.
+	OnFailure func(item Item, err error)
+	// Budget counts bytes saved in cycle.
+	Budget *ByteBudget
+	// Limiter limits total download speed of workers. nil means unlimited.
+	Limiter *RateLimiter
+
+	// FilenameTemplate renders name of file from FilenameData. when it is
+	// nil, last segment of url is used.
+	FilenameTemplate *template.Template
+	queue            chan Item
+}
+
+// NewSaver returns Saver whose queue buffers queueSize items. agents block
+// when it is full. queueSize 0 means twice of concurrency.
+func NewSaver(storage Storage, concurrency int, maxRetries int, queueSize int) *Saver {
+	s := &Saver{Storage: storage, Concurrency: concurrency, MaxRetries: maxRetries}
+	if queueSize <= 0 {
+		queueSize = concurrency * 2
+	}
+	s.queue = make(chan Item, queueSize)
+	return s
+}
+
+// Run starts fixed number of workers which save urls from queue.
+func (s *Saver) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range s.queue {
+				if item.Stats == nil {
+					item.Stats = &Stats{}
+				}
+				result, err := s.Save(ctx, item)
+				if err != nil {
+					item.Stats.Errors.Add(1)
+					metrics.DownloadErrors.Add(1)
+					s.Error(err)
+					s.markDead(item.Url, err)
+					key, _ := s.Key(item)
+					result = &Result{Status: ResultFailed, Key: key}
+					if s.OnFailure != nil {
+						s.OnFailure(item, err)
+					}
+					if s.OnEvent != nil {
+						event := itemEvent(EventDownloadFailed, item)
+						event.Error = err.Error()
+						s.OnEvent(event)
+					}
+				} else if result.Status == ResultSaved {
+					if s.OnEvent != nil {
+						event := itemEvent(EventDownloadCompleted, item)
+						event.Key = result.Key
+						event.Size = result.Size
+						s.OnEvent(event)
+					}
+					if s.OnSaved != nil {
+						s.OnSaved(ctx, item, result)
+					}
+				}
+				if s.Manifest != nil && !s.DryRun {
+					if err := s.Manifest.Record(item, result, err); err != nil {
+						s.Error("failed to write manifest: ", err)
+					}
+				}
+				item.Stats.finish()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Queue returns queue of items to be saved by Run.
+func (s *Saver) Queue() chan<- Item {
+	return s.queue
+}
+
+// Close closes queue. Run returns after queued items are saved.
+func (s *Saver) Close() {
+	close(s.queue)
+}
+
+// Save saves item to Dir/<hostname>. it retries up to MaxRetries times with
+// exponential backoff when download fails by network error or 5xx response.
+func (s *Saver) Save(ctx context.Context, item Item) (*Result, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := s.save(ctx, item)
+		if err == nil || attempt > s.MaxRetries || ctx.Err() != nil {
+			return result, err
+		}
+		retry, wait := s.classifyRetry(err, attempt)
+		if !retry {
+			return result, err
+		}
+		s.Warn("failed to save ", item.Url, ": ", err, ". retry (attempt ", attempt, ") after ", wait)
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// classifyRetry decides whether failed attempt of save is retried and how
+// long it waits before that.
+//
+//   - 429 waits for Retry-After.
+//   - network errors and 5xx wait for RetryBackoff doubled by each attempt.
+//   - 404, 410 and other errors are not retried. 404 and 410 are recorded to
+//     Dead by Run.
+func (s *Saver) classifyRetry(err error, attempt int) (bool, time.Duration) {
+	var rateErr *RateLimitError
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &rateErr):
+		return true, rateErr.RetryAfter
+	case errors.As(err, &statusErr) && statusErr.StatusCode < 500:
+		return false, 0
+	case isRetryable(err):
+		backoff := s.RetryBackoff
+		if backoff <= 0 {
+			backoff = DefaultRetryBackoff
+		}
+		return true, backoff << uint(attempt-1)
+	}
+	return false, 0
+}
+
+// DefaultRetryBackoff is wait before first retry of Saver whose RetryBackoff
+// is 0.
+const DefaultRetryBackoff = time.Second
+
+// Result is outcome of saving an item.
+type Result struct {
+	Status string
+	Key    string
+	Size   int64
+}
+
+const (
+	ResultSaved   = "saved"
+	ResultSkipped = "skipped"
+	ResultFailed  = "failed"
+)
+
+// FilenameData is passed to Saver.FilenameTemplate.
+type FilenameData struct {
+	Blog   string
+	PostID int64
+	Index  int
+	// Size is size of photo like "500" when several sizes are saved.
+	Size string
+	// Name is last segment of url, with "_<size>" before extension when Size
+	// is set.
+	Name string
+	// Ext is extension of Name with dot like ".jpg".
+	Ext string
+}
+
+// Key returns key of storage where item is saved.
+func (s *Saver) Key(item Item) (string, error) {
+	name := urlName(item.Url)
+	if item.Size != "" {
+		ext := path.Ext(name)
+		name = strings.TrimSuffix(name, ext) + "_" + item.Size + ext
+	}
+	if s.FilenameTemplate != nil {
+		var err error
+		name, err = renderFilename(s.FilenameTemplate, &FilenameData{
+			Blog:   item.Hostname,
+			PostID: item.PostId,
+			Index:  item.Index,
+			Size:   item.Size,
+			Name:   name,
+			Ext:    path.Ext(name),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return path.Join(item.Hostname, s.layoutDir(item), name), nil
+}
+
+// renderFilename renders path of file under blog directory. it may contain
+// directories separated by slash, but must not be out of blog directory.
+func renderFilename(tmpl *template.Template, data *FilenameData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	name := path.Clean(buf.String())
+	if buf.Len() == 0 || name == "." || strings.HasSuffix(buf.String(), "/") {
+		return "", errors.New("empty filename by template")
+	}
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("filename %q by template is out of blog directory", name)
+	}
+	return name, nil
+}
+
+// ValidateFilenameTemplate renders tmpl with example data, so that unknown
+// fields or invalid paths are found before saving.
+func ValidateFilenameTemplate(tmpl *template.Template) error {
+	_, err := renderFilename(tmpl, &FilenameData{
+		Blog:   "example.tumblr.com",
+		PostID: 1,
+		Index:  0,
+		Name:   "tumblr_example_1280.jpg",
+		Ext:    ".jpg",
+	})
+	return err
+}
+
+// urlName returns last segment of normalized url, which is default name of
+// file.
+func urlName(url string) string {
+	splited := strings.Split(NormalizeURL(url), "/")
+	return splited[len(splited)-1]
+}
+
+// mediaHostSuffix is suffix of hosts of tumblr media cdn like
+// "64.media.tumblr.com".
+const mediaHostSuffix = ".media.tumblr.com"
+
+// NormalizeURL returns canonical form of media url, which is used to name
+// file and to find urls saved before. it is conservative and only rewrites
+// urls on tumblr media cdn (*.media.tumblr.com), whose files are same on all
+// of numbered hosts and do not depend on query:
+//
+//   - scheme becomes https and host becomes lower case
+//   - numbered host like "66.media.tumblr.com" becomes "64.media.tumblr.com"
+//   - query and fragment are removed
+//
+// size token in path is kept, because different sizes are different files.
+// other urls are returned as is.
+func NormalizeURL(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	host := strings.ToLower(u.Host)
+	if !strings.HasSuffix(host, mediaHostSuffix) {
+		return rawurl
+	}
+	if prefix := strings.TrimSuffix(host, mediaHostSuffix); isDigits(prefix) {
+		host = "64" + mediaHostSuffix
+	}
+	u.Scheme = "https"
+	u.Host = host
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String()
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// urlExt returns lower case extension of file of url without dot.
+func urlExt(url string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(urlName(url)), "."))
+}
+
+const (
+	LayoutFlat = "flat"
+	LayoutDate = "date"
+	// LayoutDownloadDate puts files by local date when they are saved. files
+	// saved on other days are not found by it, so they are skipped only by
+	// list of downloaded urls.
+	LayoutDownloadDate = "download-date"
+)
+
+func ValidateLayout(layout string) error {
+	switch layout {
+	case LayoutFlat, LayoutDate, LayoutDownloadDate:
+		return nil
+	}
+	return errors.New("invalid layout: " + layout)
+}
+
+// layoutDir returns directory of item under blog directory.
+func (s *Saver) layoutDir(item Item) string {
+	switch s.Layout {
+	case LayoutDate:
+		if item.Timestamp == 0 {
+			return ""
+		}
+		t := time.Unix(item.Timestamp, 0).UTC()
+		return path.Join(t.Format("2006"), t.Format("01"))
+	case LayoutDownloadDate:
+		return time.Now().Format("2006-01-02")
+	}
+	return ""
+}
+
+func (s *Saver) save(ctx context.Context, item Item) (*Result, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	url := item.Url
+	key, err := s.Key(item)
+	if err != nil {
+		return nil, err
+	}
+	skipped := &Result{Status: ResultSkipped, Key: key}
+
+	if s.DryRun {
+		s.Log("would save ", url, " to ", key)
+		return skipped, nil
+	}
+
+	if err := s.checkFreeSpace(); err != nil {
+		s.Warn(err, ". so skip ", url)
+		return nil, err
+	}
+
+	// extension is added to key by content type when url has no extension.
+	noExt := path.Ext(key) == ""
+	existing, err := s.existingKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case existing != "" && s.Verify:
+		ok, err := s.verifySize(ctx, url, existing)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			s.VerifyStats.OK.Add(1)
+			item.Stats.Skipped.Add(1)
+			skipped.Key = existing
+			return skipped, s.markDownloaded(url)
+		}
+		s.Warn("size of ", existing, " does not match ", url, ". so download it again.")
+		s.VerifyStats.Corrupt.Add(1)
+		key = existing
+		noExt = false
+	case existing != "":
+		s.Log(existing, " is exists. so skip it.")
+		item.Stats.Skipped.Add(1)
+		skipped.Key = existing
+		return skipped, s.markDownloaded(url)
+	case s.Verify:
+		s.Warn(key, " is missing. so download it again.")
+		s.VerifyStats.Missing.Add(1)
+	}
+
+	if s.OnEvent != nil {
+		s.OnEvent(itemEvent(EventDownloadStarted, item))
+	}
+
+	start := time.Now()
+	req, err := s.client().NewRequest(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	// resume from partial content left by interrupted download. it is not
+	// resumed with dedupe, because hash needs whole content.
+	resumable, _ := s.Storage.(ResumableStorage)
+	var offset int64
+	if resumable != nil && s.Hashes == nil && !noExt {
+		offset = resumable.PartialSize(key)
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+	}
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, &temporaryError{err}
+	}
+
+	defer resp.Body.Close()
+
+	// total is expected size of whole file. -1 means unknown.
+	total := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// server ignored range. restart from zero.
+		offset = 0
+	case http.StatusPartialContent:
+		rangeStart, completeSize, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || rangeStart != offset {
+			if resumable != nil {
+				resumable.Discard(key)
+			}
+			return nil, &temporaryError{fmt.Errorf("unexpected content range %q: %s", resp.Header.Get("Content-Range"), url)}
+		}
+		s.Log("resume ", url, " from ", offset, " bytes")
+		total = completeSize
+	case http.StatusRequestedRangeNotSatisfiable:
+		if resumable != nil {
+			resumable.Discard(key)
+		}
+		return nil, &temporaryError{fmt.Errorf("range not satisfiable: %s", url)}
+	case http.StatusTooManyRequests:
+		return nil, &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	default:
+		return nil, &StatusError{Url: url, StatusCode: resp.StatusCode}
+	}
+
+	if s.MaxFileSize > 0 && total > s.MaxFileSize {
+		if resumable != nil {
+			resumable.Discard(key)
+		}
+		s.Log(url, " is too large (", total, " bytes). so skip it.")
+		item.Stats.Skipped.Add(1)
+		return skipped, nil
+	}
+
+	// sniff content when server does not tell type of it.
+	br := bufio.NewReader(resp.Body)
+	contentType := resp.Header.Get("Content-Type")
+	if offset == 0 && (contentType == "" || strings.HasPrefix(contentType, "application/octet-stream")) {
+		head, _ := br.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+	if !isMediaType(contentType) {
+		if resumable != nil {
+			resumable.Discard(key)
+		}
+		s.Log(url, " is not image or video (", contentType, "). so refuse it.")
+		return nil, fmt.Errorf("unexpected content type %q: %s", contentType, url)
+	}
+	if ext := extByType(contentType); noExt && ext != "" {
+		key += ext
+		skipped.Key = key
+		exists, err := s.Storage.Exists(key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			s.Log(key, " is exists. so skip it.")
+			item.Stats.Skipped.Add(1)
+			return skipped, s.markDownloaded(url)
+		}
+	}
+
+	body := &bodyReader{r: s.Limiter.Reader(ctx, br), expected: resp.ContentLength}
+	if body.expected < 0 && total >= 0 {
+		body.expected = total - offset
+	}
+	if s.MaxFileSize > 0 {
+		body.max = s.MaxFileSize - offset
+	}
+
+	hasher := sha256.New()
+	var r io.Reader = body
+	if s.Hashes != nil {
+		// hash while writing, so that big file is not buffered in memory.
+		r = io.TeeReader(body, hasher)
+	}
+
+	if resumable != nil {
+		err = resumable.PutFrom(key, offset, r)
+	} else {
+		err = s.Storage.Put(key, r)
+	}
+	if err != nil {
+		var readErr *readError
+		switch {
+		case errors.As(err, &readErr):
+			// keep partial content to resume only when server supports
+			// range request.
+			if resumable != nil && resp.Header.Get("Accept-Ranges") != "bytes" {
+				resumable.Discard(key)
+			}
+			return nil, &temporaryError{readErr.err}
+		case errors.Is(err, errTooLarge):
+			if resumable != nil {
+				resumable.Discard(key)
+			}
+			s.Log(url, " is too large (over ", s.MaxFileSize, " bytes). so skip it.")
+			item.Stats.Skipped.Add(1)
+			return skipped, nil
+		case errors.Is(err, errSizeMismatch):
+			if resumable != nil {
+				resumable.Discard(key)
+			}
+			s.Warn("size mismatch of ", url, ": expected ", body.expected, " bytes but got ", body.n, " bytes")
+			return nil, &temporaryError{fmt.Errorf("size mismatch: %s", url)}
+		}
+		return nil, err
+	}
+	size := offset + body.n
+
+	if s.Hashes != nil {
+		sum := hex.EncodeToString(hasher.Sum(nil))
+		existing, added, err := s.Hashes.Add(sum, key)
+		if err != nil {
+			return nil, err
+		}
+		// file downloaded again may have same hash as itself.
+		if !added && existing != key {
+			s.Log(url, " is same as ", existing, ". so skip it.")
+			item.Stats.Skipped.Add(1)
+			return skipped, s.Storage.Remove(key)
+		}
+	}
+
+	// modification time of file becomes time of post. it is left as download
+	// time when timestamp of post is unknown.
+	if mts, ok := s.Storage.(ModTimeStorage); ok && item.Timestamp > 0 {
+		if err := mts.SetModTime(key, time.Unix(item.Timestamp, 0)); err != nil {
+			s.Warn("failed to set modification time of ", key, ": ", err)
+		}
+	}
+
+	if s.ThumbnailSize > 0 {
+		if err := s.writeThumbnail(key); err != nil {
+			s.Warn("failed to write thumbnail of ", key, ": ", err)
+		}
+	}
+
+	s.Log("saved ", url, " to ", key)
+	if err := s.markDownloaded(url); err != nil {
+		return nil, err
+	}
+	item.Stats.Saved.Add(1)
+	metrics.ImagesDownloaded.Add(1)
+	metrics.BytesWritten.Add(body.n)
+	s.Budget.Add(body.n)
+	if s.Verbose {
+		s.Log("stats: ", key, " bytes=", size, " elapsed=", time.Since(start))
+	}
+
+	if s.Metadata {
+		if err := s.writeMetadata(key+".json", item); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Result{Status: ResultSaved, Key: key, Size: size}, nil
+}
+
+// mediaExts is extensions of content types of media.
+var mediaExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/avif": ".avif",
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+}
+
+// extByType returns extension of contentType with dot. it is empty for
+// unknown type.
+func extByType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaExts[mediaType]
+}
+
+// existingKey returns key, or key with extension of media when key has no
+// extension, whose file with suffix exists in storage. it is empty when none
+// of them exists.
+func (s *Saver) existingKey(key string, suffix string) (string, error) {
+	keys := []string{key}
+	if path.Ext(key) == "" {
+		for _, ext := range mediaExts {
+			keys = append(keys, key+ext)
+		}
+	}
+	for _, k := range keys {
+		exists, err := s.Storage.Exists(k + suffix)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			return k, nil
+		}
+	}
+	return "", nil
+}
+
+// isMediaType reports whether contentType is image or video.
+func isMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "video/")
+}
+
+var (
+	errTooLarge     = errors.New("too large")
+	errSizeMismatch = errors.New("size mismatch")
+)
+
+// readError is an error in reading response body.
+type readError struct {
+	err error
+}
+
+func (e *readError) Error() string {
+	return e.err.Error()
+}
+
+// bodyReader reads response body and verifies its size.
+type bodyReader struct {
+	r io.Reader
+	// n is bytes read.
+	n int64
+	// expected is expected bytes of body. -1 means unknown.
+	expected int64
+	// max is max bytes of body. 0 means unlimited.
+	max int64
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.max > 0 && b.n > b.max {
+		return n, errTooLarge
+	}
+	if err == io.EOF {
+		if b.expected >= 0 && b.n != b.expected {
+			return n, errSizeMismatch
+		}
+		return n, io.EOF
+	}
+	if err != nil {
+		return n, &readError{err}
+	}
+	return n, nil
+}
+
+// parseContentRange parses Content-Range header like "bytes 100-199/200" and
+// returns start and complete length. complete length is -1 when it is unknown.
+func parseContentRange(v string) (int64, int64, error) {
+	var start, end int64
+	var size string
+	if _, err := fmt.Sscanf(v, "bytes %d-%d/%s", &start, &end, &size); err != nil {
+		return 0, 0, err
+	}
+	if size == "*" {
+		return start, -1, nil
+	}
+	total, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, total, nil
+}
+
+// VerifyStats is counters of existing files checked by Verify.
+type VerifyStats struct {
+	OK      atomic.Int64
+	Missing atomic.Int64
+	Corrupt atomic.Int64
+}
+
+func (s *VerifyStats) String() string {
+	return fmt.Sprintf("ok=%d missing=%d corrupt=%d", s.OK.Load(), s.Missing.Load(), s.Corrupt.Load())
+}
+
+// verifySize reports whether size of key matches Content-Length of url. it
+// is true when either size is unknown, so that file is not downloaded again
+// needlessly.
+func (s *Saver) verifySize(ctx context.Context, url string, key string) (bool, error) {
+	ss, ok := s.Storage.(SizeStorage)
+	if !ok {
+		return true, nil
+	}
+	size, err := ss.Size(key)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := s.client().NewRequest(ctx, url)
+	if err != nil {
+		return false, err
+	}
+	req.Method = http.MethodHead
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return false, &temporaryError{err}
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		s.Warn("can not verify ", key, ": unexpected status ", resp.StatusCode, " of ", url)
+		return true, nil
+	}
+	return resp.ContentLength < 0 || resp.ContentLength == size, nil
+}
+
+// LowSpace reports whether free space of storage is under MinFree. it is
+// false when MinFree is 0 or storage can not report free space.
+func (s *Saver) LowSpace() bool {
+	return s.checkFreeSpace() != nil
+}
+
+func (s *Saver) checkFreeSpace() error {
+	if s.MinFree <= 0 {
+		return nil
+	}
+	fss, ok := s.Storage.(FreeSpaceStorage)
+	if !ok {
+		return nil
+	}
+	free, err := fss.FreeSpace()
+	if err != nil {
+		s.Warn("failed to get free space: ", err)
+		return nil
+	}
+	if free < s.MinFree {
+		return &LowSpaceError{Free: free, MinFree: s.MinFree}
+	}
+	return nil
+}
+
+// LowSpaceError is returned when free space of storage is under MinFree.
+type LowSpaceError struct {
+	Free    int64
+	MinFree int64
+}
+
+func (e *LowSpaceError) Error() string {
+	return fmt.Sprintf("free space %d bytes is under min free %d bytes", e.Free, e.MinFree)
+}
+
+// markDead adds url to Dead when err tells that it is removed.
+func (s *Saver) markDead(url string, err error) {
+	var statusErr *StatusError
+	if s.Dead == nil || !errors.As(err, &statusErr) {
+		return
+	}
+	if statusErr.StatusCode != http.StatusNotFound && statusErr.StatusCode != http.StatusGone {
+		return
+	}
+	s.Log(url, " is dead (status ", statusErr.StatusCode, "). so it is not queued again")
+	if err := s.Dead.Add(NormalizeURL(url)); err != nil {
+		s.Error("failed to record dead url: ", err)
+	}
+}
+
+func (s *Saver) markDownloaded(url string) error {
+	if s.Downloaded == nil {
+		return nil
+	}
+	return s.Downloaded.Add(NormalizeURL(url))
+}
+
+// HasMetadata reports whether metadata sidecar of item exists. it only checks
+// existence, so file of item may be moved or removed.
+func (s *Saver) HasMetadata(item Item) bool {
+	key, err := s.Key(item)
+	if err != nil {
+		return false
+	}
+	existing, err := s.existingKey(key, ".json")
+	return err == nil && existing != ""
+}
+
+func (s *Saver) writeMetadata(key string, item Item) error {
+	data, err := json.MarshalIndent(&Metadata{
+		PostId:    item.PostId,
+		Blog:      item.Hostname,
+		PostUrl:   item.PostUrl,
+		Timestamp: item.Timestamp,
+		Url:       item.Url,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return s.Storage.Put(key, bytes.NewReader(data))
+}
+
+func (s *Saver) client() *Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return &Client{}
+}
+
+func (s *Saver) Log(v ...interface{}) {
+	logger.Log(LevelInfo, "saver", "", fmt.Sprint(v...))
+}
+
+func (s *Saver) Warn(v ...interface{}) {
+	logger.Log(LevelWarn, "saver", "", fmt.Sprint(v...))
+}
+
+func (s *Saver) Error(v ...interface{}) {
+	logger.Log(LevelError, "saver", "", fmt.Sprint(v...))
+}
+
+// StatusError is returned when server responds with unexpected status code.
+type StatusError struct {
+	Url        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d: %s", e.StatusCode, e.Url)
+}
+
+// temporaryError is an error which may be resolved by retrying.
+type temporaryError struct {
+	err error
+}
+
+func (e *temporaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e *temporaryError) Unwrap() error {
+	return e.err
+}
+
+func isRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	var tempErr *temporaryError
+	return errors.As(err, &tempErr)
+}
@@ -0,0 +1,199 @@
+package tumblream
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newStatusServer returns server which responds status to every request, and
+// counter of requests.
+func newStatusServer(t *testing.T, status int, header http.Header) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func newTestSaver(t *testing.T, srv *httptest.Server, maxRetries int) *Saver {
+	t.Helper()
+	s := NewSaver(&FileStorage{Dir: t.TempDir()}, 1, maxRetries, 0)
+	s.Client = &Client{HTTPClient: srv.Client()}
+	s.RetryBackoff = time.Millisecond
+	return s
+}
+
+func testItem(srv *httptest.Server) Item {
+	return Item{Hostname: testHostname, Url: srv.URL + "/image.jpg", PostId: 100, Timestamp: 1700000100}
+}
+
+func TestClassifyRetry(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header http.Header
+		retry  bool
+		// waits are waits of attempts from first one.
+		waits []time.Duration
+	}{
+		{name: "not found", status: http.StatusNotFound},
+		{name: "gone", status: http.StatusGone},
+		{name: "forbidden", status: http.StatusForbidden},
+		{name: "server error", status: http.StatusInternalServerError, retry: true,
+			waits: []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}},
+		{name: "bad gateway", status: http.StatusBadGateway, retry: true,
+			waits: []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}},
+		{name: "rate limited", status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"7"}}, retry: true,
+			waits: []time.Duration{7 * time.Second, 7 * time.Second, 7 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newStatusServer(t, tt.status, tt.header)
+			s := newTestSaver(t, srv, 0)
+			_, err := s.save(context.Background(), testItem(srv))
+			if err == nil {
+				t.Fatal("save succeeded")
+			}
+			for i := 0; i < 3; i++ {
+				retry, wait := s.classifyRetry(err, i+1)
+				if retry != tt.retry {
+					t.Fatalf("retry of %v is %v, want %v", err, retry, tt.retry)
+				}
+				if tt.retry && wait != tt.waits[i] {
+					t.Errorf("wait of attempt %d is %s, want %s", i+1, wait, tt.waits[i])
+				}
+			}
+		})
+	}
+}
+
+func TestClassifyRetryNetworkError(t *testing.T) {
+	srv, _ := newStatusServer(t, http.StatusOK, nil)
+	s := newTestSaver(t, srv, 0)
+	s.RetryBackoff = 0
+	item := testItem(srv)
+	srv.Close()
+
+	_, err := s.save(context.Background(), item)
+	if err == nil {
+		t.Fatal("save succeeded")
+	}
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		retry, wait := s.classifyRetry(err, i+1)
+		if !retry || wait != want {
+			t.Errorf("attempt %d: retry %v after %s, want retry after %s", i+1, retry, wait, want)
+		}
+	}
+}
+
+func TestSaveRetries(t *testing.T) {
+	t.Run("server error", func(t *testing.T) {
+		srv, requests := newStatusServer(t, http.StatusServiceUnavailable, nil)
+		s := newTestSaver(t, srv, 3)
+		start := time.Now()
+		if _, err := s.Save(context.Background(), testItem(srv)); err == nil {
+			t.Fatal("save succeeded")
+		}
+		if n := requests.Load(); n != 4 {
+			t.Errorf("requested %d times, want 4", n)
+		}
+		// 1ms + 2ms + 4ms
+		if d := time.Since(start); d < 7*time.Millisecond {
+			t.Errorf("retried in %s, want backoff of 7ms at least", d)
+		}
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		srv, requests := newStatusServer(t, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}})
+		s := newTestSaver(t, srv, 1)
+		start := time.Now()
+		if _, err := s.Save(context.Background(), testItem(srv)); err == nil {
+			t.Fatal("save succeeded")
+		}
+		if n := requests.Load(); n != 2 {
+			t.Errorf("requested %d times, want 2", n)
+		}
+		if d := time.Since(start); d < time.Second {
+			t.Errorf("retried in %s, want after Retry-After of 1s", d)
+		}
+	})
+
+	for _, status := range []int{http.StatusNotFound, http.StatusGone} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			srv, requests := newStatusServer(t, status, nil)
+			s := newTestSaver(t, srv, 3)
+			dead, err := LoadDeadURLStore(filepath.Join(t.TempDir(), "dead.txt"), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Dead = dead
+			stats := &Stats{}
+			item := testItem(srv)
+			item.Stats = stats
+
+			s.Queue() <- item
+			s.Close()
+			s.Run(context.Background())
+
+			if n := requests.Load(); n != 1 {
+				t.Errorf("requested %d times, want 1", n)
+			}
+			if !dead.Has(item.Url) {
+				t.Errorf("%s is not marked dead", item.Url)
+			}
+			if stats.Errors.Load() != 1 {
+				t.Errorf("errors is %d, want 1", stats.Errors.Load())
+			}
+		})
+	}
+}
+
+func TestStatsWaitsForQueuedItems(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+	s := newTestSaver(t, srv, 0)
+	done := make(chan struct{})
+	go func() {
+		s.Run(context.Background())
+		close(done)
+	}()
+	defer func() {
+		s.Close()
+		<-done
+	}()
+
+	stats := &Stats{}
+	item := testItem(srv)
+	item.Stats = stats
+	s.Queue() <- item
+	stats.Queued.Add(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := stats.Wait(ctx); err == nil {
+		t.Fatal("wait returned while item is downloaded")
+	}
+
+	close(release)
+	if err := stats.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.Errors.Load(); n != 1 {
+		t.Errorf("errors are %d after wait, want 1", n)
+	}
+}
@@ -0,0 +1,198 @@
+package tumblream
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Storage stores saved files. key is slash separated path like
+// "<hostname>/<filename>".
+type Storage interface {
+	Exists(key string) (bool, error)
+	// Put stores content of r as key. when reading r or storing fails, key is
+	// not stored.
+	Put(key string, r io.Reader) error
+	Remove(key string) error
+}
+
+// ResumableStorage is Storage which keeps partial content of failed put, so
+// that download can be resumed from it.
+type ResumableStorage interface {
+	Storage
+	// PartialSize returns size of partial content of key.
+	PartialSize(key string) int64
+	// PutFrom writes r at offset of partial content of key, and stores it as
+	// key when r is read completely. offset 0 discards partial content. when
+	// it fails, partial content is kept.
+	PutFrom(key string, offset int64, r io.Reader) error
+	// Discard removes partial content of key.
+	Discard(key string) error
+}
+
+// ModTimeStorage is Storage which can change modification time of key.
+type ModTimeStorage interface {
+	Storage
+	SetModTime(key string, t time.Time) error
+}
+
+// OpenStorage is Storage which can read content of key.
+type OpenStorage interface {
+	Storage
+	Open(key string) (io.ReadCloser, error)
+}
+
+// SizeStorage is Storage which can report size of key.
+type SizeStorage interface {
+	Storage
+	Size(key string) (int64, error)
+}
+
+// FreeSpaceStorage is Storage which can report free space.
+type FreeSpaceStorage interface {
+	Storage
+	// FreeSpace returns bytes which can be stored.
+	FreeSpace() (int64, error)
+}
+
+// FileStorage stores files under Dir. partial content is kept as
+// "<filename>.tmp" and renamed after it is completed, so that interrupted put
+// never leaves truncated file.
+type FileStorage struct {
+	Dir string
+
+	// dirs is directories created by put. they are not created again.
+	dirs sync.Map
+}
+
+func NewFileStorage(dir string) *FileStorage {
+	return &FileStorage{Dir: dir}
+}
+
+// Path returns path of key in local filesystem.
+func (fs *FileStorage) Path(key string) string {
+	return filepath.Join(fs.Dir, filepath.FromSlash(key))
+}
+
+func (fs *FileStorage) tmpPath(key string) string {
+	return fs.Path(key) + ".tmp"
+}
+
+func (fs *FileStorage) Exists(key string) (bool, error) {
+	_, err := os.Stat(fs.Path(key))
+	if err == nil {
+		return true, nil
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (fs *FileStorage) Put(key string, r io.Reader) error {
+	if err := fs.PutFrom(key, 0, r); err != nil {
+		fs.Discard(key)
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStorage) Open(key string) (io.ReadCloser, error) {
+	return os.Open(fs.Path(key))
+}
+
+func (fs *FileStorage) Size(key string) (int64, error) {
+	info, err := os.Stat(fs.Path(key))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (fs *FileStorage) Remove(key string) error {
+	return os.Remove(fs.Path(key))
+}
+
+func (fs *FileStorage) PartialSize(key string) int64 {
+	info, err := os.Stat(fs.tmpPath(key))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (fs *FileStorage) PutFrom(key string, offset int64, r io.Reader) error {
+	path := fs.Path(key)
+	tmpPath := fs.tmpPath(key)
+
+	if err := fs.mkdir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		if fs.PartialSize(key) != offset {
+			return &os.PathError{Op: "resume", Path: tmpPath, Err: os.ErrInvalid}
+		}
+		flag = os.O_WRONLY | os.O_APPEND
+	}
+
+	file, err := os.OpenFile(tmpPath, flag, 0666)
+	if errors.Is(err, os.ErrNotExist) && offset == 0 {
+		// cached dir may be removed by others.
+		fs.dirs.Delete(filepath.Dir(path))
+		if err := fs.mkdir(filepath.Dir(path)); err != nil {
+			return err
+		}
+		file, err = os.OpenFile(tmpPath, flag, 0666)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// mkdir creates dir and its parents once. concurrent puts may create same
+// dir, so it is fine when dir is created by others.
+func (fs *FileStorage) mkdir(dir string) error {
+	if _, ok := fs.dirs.Load(dir); ok {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		info, statErr := os.Stat(dir)
+		if statErr != nil || !info.IsDir() {
+			return err
+		}
+	}
+	fs.dirs.Store(dir, struct{}{})
+	return nil
+}
+
+func (fs *FileStorage) Discard(key string) error {
+	err := os.Remove(fs.tmpPath(key))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStorage) SetModTime(key string, t time.Time) error {
+	return os.Chtimes(fs.Path(key), t, t)
+}
+
+func (fs *FileStorage) FreeSpace() (int64, error) {
+	return freeSpace(fs.Dir)
+}
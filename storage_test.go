@@ -0,0 +1,61 @@
+package tumblream
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// putConcurrently puts n files under dir concurrently and checks content of
+// them.
+func putConcurrently(t *testing.T, fs *FileStorage, dir string, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("%s/%d.jpg", dir, i)
+			if err := fs.PutFrom(key, 0, strings.NewReader(key)); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%s/%d.jpg", dir, i)
+		b, err := os.ReadFile(fs.Path(key))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(b) != key {
+			t.Errorf("content of %s is %q", key, b)
+		}
+	}
+}
+
+func TestFileStoragePutFromNewDir(t *testing.T) {
+	fs := NewFileStorage(t.TempDir())
+	putConcurrently(t, fs, "example.tumblr.com/2023/11", 64)
+}
+
+func TestFileStoragePutFromRemovedDir(t *testing.T) {
+	fs := NewFileStorage(t.TempDir())
+	dir := "example.tumblr.com/2023/11"
+	putConcurrently(t, fs, dir, 8)
+
+	// dir is cached, but removed by others like cleanup of user.
+	if err := os.RemoveAll(fs.Path("example.tumblr.com")); err != nil {
+		t.Fatal(err)
+	}
+	putConcurrently(t, fs, dir, 64)
+}
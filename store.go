@@ -0,0 +1,419 @@
+package tumblream
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manifest is append only log of saves. each line is tab separated time,
+// status, blog, post id, url, key, size and error.
+type Manifest struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenManifest(path string) (*Manifest, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{file: file}, nil
+}
+
+func (m *Manifest) Record(item Item, result *Result, saveErr error) error {
+	errMsg := ""
+	if saveErr != nil {
+		errMsg = strings.NewReplacer("\t", " ", "\n", " ").Replace(saveErr.Error())
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.file, "%s\t%s\t%s\t%d\t%s\t%s\t%d\t%s\n",
+		time.Now().Format(time.RFC3339), result.Status, item.Hostname, item.PostId,
+		item.Url, result.Key, result.Size, errMsg)
+	return err
+}
+
+// FailureLog is append only log of failed downloads. each line is tab
+// separated blog, post id, index, timestamp, post url, url, error and size.
+// items in it are read by ReadFailures to retry them.
+type FailureLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func OpenFailureLog(path string) (*FailureLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &FailureLog{file: file}, nil
+}
+
+func (f *FailureLog) Add(item Item, saveErr error) error {
+	errMsg := strings.NewReplacer("\t", " ", "\n", " ").Replace(saveErr.Error())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err := fmt.Fprintf(f.file, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n",
+		item.Hostname, item.PostId, item.Index, item.Timestamp, item.PostUrl, item.Url, errMsg, item.Size)
+	return err
+}
+
+// ReadFailures returns items written by FailureLog. it returns no items when
+// file does not exist.
+func ReadFailures(path string) ([]Item, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var items []Item
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 6 {
+			continue
+		}
+		item := Item{Hostname: fields[0], PostUrl: fields[4], Url: fields[5]}
+		if _, err := fmt.Sscan(fields[1], &item.PostId); err != nil {
+			return nil, fmt.Errorf("invalid post id in %s: %s", path, fields[1])
+		}
+		if _, err := fmt.Sscan(fields[2], &item.Index); err != nil {
+			return nil, fmt.Errorf("invalid index in %s: %s", path, fields[2])
+		}
+		if _, err := fmt.Sscan(fields[3], &item.Timestamp); err != nil {
+			return nil, fmt.Errorf("invalid timestamp in %s: %s", path, fields[3])
+		}
+		// size is missing in lines written by older versions.
+		if len(fields) > 7 {
+			item.Size = fields[7]
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// URLStore is a set of urls. it is persisted to file line by line.
+type URLStore struct {
+	path string
+	mu   sync.Mutex
+	urls map[string]bool
+}
+
+func LoadURLStore(path string) (*URLStore, error) {
+	u := &URLStore{path: path, urls: map[string]bool{}}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return u, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			u.urls[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (u *URLStore) Has(url string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.urls[url]
+}
+
+// Add adds url and appends it to file.
+func (u *URLStore) Add(url string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.urls[url] {
+		return nil
+	}
+
+	file, err := os.OpenFile(u.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintln(file, url); err != nil {
+		return err
+	}
+
+	u.urls[url] = true
+	return nil
+}
+
+// DeadURLStore is a set of urls which responded 404 or 410. it is persisted
+// to file as lines of "<url>\t<unix time>". url is regarded as alive again
+// when TTL passed since it is added. TTL 0 means forever.
+type DeadURLStore struct {
+	TTL time.Duration
+
+	path string
+	mu   sync.Mutex
+	urls map[string]time.Time
+}
+
+func LoadDeadURLStore(path string, ttl time.Duration) (*DeadURLStore, error) {
+	d := &DeadURLStore{TTL: ttl, path: path, urls: map[string]time.Time{}}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return d, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		// url added again after TTL appears later.
+		d.urls[fields[0]] = time.Unix(sec, 0)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Has reports whether url is dead and TTL has not passed.
+func (d *DeadURLStore) Has(url string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.urls[url]
+	return ok && (d.TTL <= 0 || time.Since(t) < d.TTL)
+}
+
+// Add adds url with current time and appends it to file.
+func (d *DeadURLStore) Add(url string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	now := time.Now()
+	if _, err := fmt.Fprintf(file, "%s\t%d\n", url, now.Unix()); err != nil {
+		return err
+	}
+
+	d.urls[url] = now
+	return nil
+}
+
+// HashStore is a set of sha256 of saved files. it is persisted to file as
+// lines of "<hash>\t<filename>".
+type HashStore struct {
+	path   string
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+func LoadHashStore(path string) (*HashStore, error) {
+	h := &HashStore{path: path, hashes: map[string]string{}}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return h, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		h.hashes[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Add adds hash of fileName. when hash already exists, it returns filename of
+// the hash and false.
+func (h *HashStore) Add(hash string, fileName string) (string, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if existing, ok := h.hashes[hash]; ok {
+		return existing, false, nil
+	}
+
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return "", false, err
+	}
+	defer file.Close()
+
+	if _, err := fmt.Fprintf(file, "%s\t%s\n", hash, fileName); err != nil {
+		return "", false, err
+	}
+
+	h.hashes[hash] = fileName
+	return "", true, nil
+}
+
+// State is persisted progress of agents, keyed by hostname.
+type State struct {
+	path  string
+	mu    sync.Mutex
+	Blogs map[string]*BlogState `json:"blogs"`
+}
+
+type BlogState struct {
+	LastId int64 `json:"last_id"`
+	// LastFetched is unix time when agent succeeded last time.
+	LastFetched int64 `json:"last_fetched,omitempty"`
+	// Saved is total number of files saved from blog.
+	Saved int64 `json:"saved,omitempty"`
+}
+
+func LoadState(path string) (*State, error) {
+	s := &State{path: path, Blogs: map[string]*BlogState{}}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := json.NewDecoder(file).Decode(s); err != nil {
+		return nil, err
+	}
+	if s.Blogs == nil {
+		s.Blogs = map[string]*BlogState{}
+	}
+	return s, nil
+}
+
+func (s *State) LastId(hostname string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b, ok := s.Blogs[hostname]; ok {
+		return b.LastId
+	}
+	return 0
+}
+
+// Blog returns copy of state of hostname. it is zero value for unknown blog.
+func (s *State) Blog(hostname string) BlogState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b, ok := s.Blogs[hostname]; ok {
+		return *b
+	}
+	return BlogState{}
+}
+
+func (s *State) blog(hostname string) *BlogState {
+	b, ok := s.Blogs[hostname]
+	if !ok {
+		b = &BlogState{}
+		s.Blogs[hostname] = b
+	}
+	return b
+}
+
+// SetLastId updates last id of hostname with time of success, and writes
+// state to file.
+func (s *State) SetLastId(hostname string, lastId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.blog(hostname)
+	b.LastId = lastId
+	b.LastFetched = time.Now().Unix()
+
+	return s.save()
+}
+
+// AddSaved counts a file saved from hostname. it is written to file with
+// next SetLastId or Flush.
+func (s *State) AddSaved(hostname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blog(hostname).Saved++
+}
+
+// Flush writes state to file.
+func (s *State) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.save()
+}
+
+// save writes state to temp file and renames it, so that state file is never
+// left half written.
+func (s *State) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
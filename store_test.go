@@ -0,0 +1,51 @@
+package tumblream
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFailureLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.tsv")
+	items := []Item{
+		{Hostname: testHostname, Url: "https://64.media.tumblr.com/a_1280.jpg", Index: 1, Size: "1280", PostId: 100, PostUrl: "https://example.tumblr.com/post/100", Timestamp: 1700000100},
+		{Hostname: testHostname, Url: "https://64.media.tumblr.com/b_1280.jpg", PostId: 200, PostUrl: "https://example.tumblr.com/post/200", Timestamp: 1700000200},
+	}
+
+	f, err := OpenFailureLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if err := f.Add(item, errors.New("failed\twith\ntabs")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := ReadFailures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, items) {
+		t.Errorf("ReadFailures() = %+v, want %+v", got, items)
+	}
+}
+
+func TestReadFailuresWithoutSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.tsv")
+	line := "example.tumblr.com\t100\t0\t1700000100\thttps://example.tumblr.com/post/100\thttps://64.media.tumblr.com/a_1280.jpg\terr\n"
+	if err := os.WriteFile(path, []byte(line), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadFailures(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].PostId != 100 || got[0].Size != "" {
+		t.Errorf("ReadFailures() = %+v", got)
+	}
+}
@@ -0,0 +1,109 @@
+package tumblream
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strings"
+)
+
+// ThumbnailDir is directory of thumbnails under blog directory.
+const ThumbnailDir = "thumbs"
+
+// thumbnailKey returns key of thumbnail of key. it is same path under
+// ThumbnailDir of blog with extension of format.
+func thumbnailKey(key string, format string) string {
+	blog, rest, _ := strings.Cut(key, "/")
+	ext := ".jpg"
+	if format != "jpeg" {
+		ext = ".png"
+	}
+	rest = strings.TrimSuffix(rest, path.Ext(rest)) + ext
+	return path.Join(blog, ThumbnailDir, rest)
+}
+
+// writeThumbnail writes thumbnail of saved key whose long side is
+// ThumbnailSize. files which are not decodable as image like videos are
+// ignored.
+func (s *Saver) writeThumbnail(key string) error {
+	ops, ok := s.Storage.(OpenStorage)
+	if !ok {
+		return nil
+	}
+	r, err := ops.Open(key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	src, format, err := image.Decode(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	dst := resize(src, s.ThumbnailSize)
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Storage.Put(thumbnailKey(key, format), &buf)
+}
+
+// resize scales src so that its long side becomes size by averaging pixels.
+// src smaller than size is not enlarged.
+func resize(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+	dw, dh := size, sh*size/sw
+	if sh > sw {
+		dw, dh = sw*size/sh, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+(y+1)*sh/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+(x+1)*sw/dw
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := color.NRGBA64Model.Convert(src.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.Set(x, y, color.NRGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,278 @@
+package tumblream
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+type TumblrResponse struct {
+	Meta struct {
+		Status int    `json:"status"`
+		Msg    string `json:"msg"`
+	} `json:"meta"`
+	Response struct {
+		Posts      []TumblrResponsePost `json:"posts"`
+		TotalPosts int64                `json:"total_posts"`
+		LikedPosts []TumblrResponsePost `json:"liked_posts"`
+		LikedCount int64                `json:"liked_count"`
+	} `json:"response"`
+}
+
+// Posts returns posts or liked posts of response.
+func (r *TumblrResponse) Posts() []TumblrResponsePost {
+	if r.Response.LikedPosts != nil {
+		return r.Response.LikedPosts
+	}
+	return r.Response.Posts
+}
+
+// Total returns total number of posts or liked posts.
+func (r *TumblrResponse) Total() int64 {
+	if r.Response.LikedPosts != nil {
+		return r.Response.LikedCount
+	}
+	return r.Response.TotalPosts
+}
+
+type TumblrResponsePost struct {
+	Id        int64  `json:"id"`
+	Type      string `json:"type"`
+	PostUrl   string `json:"post_url"`
+	Timestamp int64  `json:"timestamp"`
+	// LikedTimestamp is set only for liked posts.
+	LikedTimestamp int64    `json:"liked_timestamp"`
+	Tags           []string `json:"tags"`
+	// RebloggedFromId is empty for original post.
+	RebloggedFromId json.Number           `json:"reblogged_from_id"`
+	Photos          []TumblrResponsePhoto `json:"photos"`
+	VideoUrl        string                `json:"video_url"`
+	// Content is content blocks of post in NPF (neue post format). media of
+	// post made in NPF is in it instead of Photos.
+	Content []TumblrResponseBlock `json:"content"`
+	// Trail is reblogged posts. their content blocks are in it for reblog in
+	// NPF.
+	Trail []TumblrResponseTrail `json:"trail"`
+}
+
+// TumblrResponseTrail is a reblogged post in trail of post.
+type TumblrResponseTrail struct {
+	// Content is content blocks in NPF response, but it is html in legacy
+	// response. so it is decoded only by Images.
+	Content json.RawMessage `json:"content"`
+}
+
+// TumblrResponseBlock is a content block of NPF.
+type TumblrResponseBlock struct {
+	Type string `json:"type"`
+	// Media is array of sizes for image block, but it is an object for
+	// video and audio block. so it is decoded by type.
+	Media json.RawMessage `json:"media"`
+}
+
+type tumblrResponseMedia struct {
+	TumblrResponsePhotoSize
+	HasOriginalDimensions bool `json:"has_original_dimensions"`
+}
+
+// Images returns photos of post. for post in NPF, they are made from image
+// blocks of reblogged posts in trail and of content. malformed blocks are
+// ignored.
+func (p *TumblrResponsePost) Images() []TumblrResponsePhoto {
+	if len(p.Photos) > 0 {
+		return p.Photos
+	}
+	var blocks []TumblrResponseBlock
+	for _, trail := range p.Trail {
+		var content []TumblrResponseBlock
+		if err := json.Unmarshal(trail.Content, &content); err != nil {
+			continue
+		}
+		blocks = append(blocks, content...)
+	}
+	blocks = append(blocks, p.Content...)
+
+	var photos []TumblrResponsePhoto
+	for _, block := range blocks {
+		if block.Type != "image" {
+			continue
+		}
+		var media []tumblrResponseMedia
+		if err := json.Unmarshal(block.Media, &media); err != nil {
+			continue
+		}
+		var photo TumblrResponsePhoto
+		for i := range media {
+			photo.AltSizes = append(photo.AltSizes, media[i].TumblrResponsePhotoSize)
+			if media[i].HasOriginalDimensions && photo.OriginalSize == nil {
+				photo.OriginalSize = &media[i].TumblrResponsePhotoSize
+			}
+		}
+		photos = append(photos, photo)
+	}
+	return photos
+}
+
+type TumblrResponsePhoto struct {
+	OriginalSize *TumblrResponsePhotoSize  `json:"original_size"`
+	AltSizes     []TumblrResponsePhotoSize `json:"alt_sizes"`
+}
+
+// IsGif reports whether original of the photo is gif.
+func (p *TumblrResponsePhoto) IsGif() bool {
+	return p.OriginalSize != nil && isGifUrl(p.OriginalSize.Url)
+}
+
+func isGifUrl(u string) bool {
+	if parsed, err := url.Parse(u); err == nil {
+		u = parsed.Path
+	}
+	return strings.EqualFold(path.Ext(u), ".gif")
+}
+
+type TumblrResponsePhotoSize struct {
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+	Url    string  `json:"url"`
+}
+
+// IsReblog reports whether post is a reblog.
+func (p *TumblrResponsePost) IsReblog() bool {
+	return p.RebloggedFromId != "" && p.RebloggedFromId != "0"
+}
+
+const (
+	ReblogsAll     = "all"
+	ReblogsExclude = "exclude"
+	ReblogsOnly    = "only"
+)
+
+func ValidateReblogs(reblogs string) error {
+	switch reblogs {
+	case ReblogsAll, ReblogsExclude, ReblogsOnly:
+		return nil
+	}
+	return errors.New("invalid reblogs: " + reblogs)
+}
+
+const (
+	SourcePosts = "posts"
+	SourceLikes = "likes"
+)
+
+const (
+	StatePublished = "published"
+	StateQueue     = "queue"
+	StateDraft     = "draft"
+)
+
+func ValidateStates(states []string) error {
+	for _, state := range states {
+		switch state {
+		case StatePublished, StateQueue, StateDraft:
+		default:
+			return errors.New("invalid state: " + state)
+		}
+	}
+	return nil
+}
+
+func ValidateSource(source string) error {
+	switch source {
+	case SourcePosts, SourceLikes:
+		return nil
+	}
+	return errors.New("invalid source: " + source)
+}
+
+func ValidateTypes(types []string) error {
+	if len(types) == 0 {
+		return errors.New("empty types")
+	}
+	for _, typ := range types {
+		switch typ {
+		case "photo", "video":
+		default:
+			return errors.New("unsupported type: " + typ)
+		}
+	}
+	return nil
+}
+
+func ValidateSize(size string) error {
+	switch size {
+	case "original", "largest", "smallest":
+		return nil
+	}
+	width, err := strconv.Atoi(size)
+	if err != nil || width <= 0 {
+		return errors.New("invalid size: " + size)
+	}
+	return nil
+}
+
+// SelectSize returns alt size matched to size. size is one of original, largest,
+// smallest or width in pixel. when exact width is not found, closest larger one
+// is returned (or largest one if there is no larger one). original returns
+// original_size if it exists, because resized sizes of animated gif are still
+// images. sizes without url (deleted or restricted media) are ignored, and
+// false is returned when there is no usable size.
+func (p *TumblrResponsePhoto) SelectSize(size string) (*TumblrResponsePhotoSize, bool) {
+	if size == "original" && p.OriginalSize != nil && p.OriginalSize.Url != "" {
+		return p.OriginalSize, true
+	}
+
+	var largest, smallest *TumblrResponsePhotoSize
+	for i := range p.AltSizes {
+		s := &p.AltSizes[i]
+		if s.Url == "" {
+			continue
+		}
+		if largest == nil || s.Width*s.Height > largest.Width*largest.Height {
+			largest = s
+		}
+		if smallest == nil || s.Width*s.Height < smallest.Width*smallest.Height {
+			smallest = s
+		}
+	}
+
+	if largest == nil {
+		return nil, false
+	}
+
+	switch size {
+	case "original":
+		return largest, true
+	case "largest":
+		// largest alt size of gif may be a still image.
+		if p.IsGif() && !isGifUrl(largest.Url) {
+			return p.OriginalSize, true
+		}
+		return largest, true
+	case "smallest":
+		return smallest, true
+	}
+
+	width, err := strconv.Atoi(size)
+	if err != nil {
+		return nil, false
+	}
+
+	var closest *TumblrResponsePhotoSize
+	for i := range p.AltSizes {
+		s := &p.AltSizes[i]
+		if s.Url == "" || s.Width < float64(width) {
+			continue
+		}
+		if closest == nil || s.Width < closest.Width {
+			closest = s
+		}
+	}
+	if closest == nil {
+		return largest, true
+	}
+	return closest, true
+}
@@ -0,0 +1,109 @@
+package tumblream
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSelectSize(t *testing.T) {
+	photo := TumblrResponsePhoto{
+		OriginalSize: &TumblrResponsePhotoSize{Width: 2048, Height: 1536},
+		AltSizes: []TumblrResponsePhotoSize{
+			{Width: 1280, Height: 960},
+			{Width: 640, Height: 480, Url: "https://64.media.tumblr.com/a_640.jpg"},
+			{Width: 500, Height: 375},
+			{Width: 400, Height: 300, Url: "https://64.media.tumblr.com/a_400.jpg"},
+			{Width: 75, Height: 75},
+		},
+	}
+	tests := []struct {
+		size string
+		want string
+	}{
+		{size: "original", want: "https://64.media.tumblr.com/a_640.jpg"},
+		{size: "largest", want: "https://64.media.tumblr.com/a_640.jpg"},
+		{size: "smallest", want: "https://64.media.tumblr.com/a_400.jpg"},
+		{size: "500", want: "https://64.media.tumblr.com/a_640.jpg"},
+		{size: "400", want: "https://64.media.tumblr.com/a_400.jpg"},
+		{size: "1280", want: "https://64.media.tumblr.com/a_640.jpg"},
+	}
+	for _, tt := range tests {
+		got, ok := photo.SelectSize(tt.size)
+		if !ok {
+			t.Errorf("SelectSize(%q) found no size", tt.size)
+			continue
+		}
+		if got.Url != tt.want {
+			t.Errorf("SelectSize(%q) = %s, want %s", tt.size, got.Url, tt.want)
+		}
+	}
+}
+
+func TestSelectSizeWithoutUsableSize(t *testing.T) {
+	photos := map[string]TumblrResponsePhoto{
+		"empty alt sizes": {},
+		"alt sizes without url": {
+			OriginalSize: &TumblrResponsePhotoSize{Width: 1280, Height: 960},
+			AltSizes:     []TumblrResponsePhotoSize{{Width: 1280, Height: 960}, {Width: 75, Height: 75}},
+		},
+	}
+	for name, photo := range photos {
+		for _, size := range []string{"original", "largest", "smallest", "500"} {
+			if got, ok := photo.SelectSize(size); ok {
+				t.Errorf("%s: SelectSize(%q) = %+v, want none", name, size, got)
+			}
+		}
+	}
+}
+
+func TestImagesOfNPF(t *testing.T) {
+	var post TumblrResponsePost
+	body := `{
+		"id": 100,
+		"type": "blocks",
+		"trail": [{"content": [{"type": "image", "media": [
+			{"url": "https://64.media.tumblr.com/a_1280.jpg", "width": 1280, "height": 960, "has_original_dimensions": true},
+			{"url": "https://64.media.tumblr.com/a_500.jpg", "width": 500, "height": 375}
+		]}]}],
+		"content": [
+			{"type": "text", "text": "caption"},
+			{"type": "image", "media": [{"url": "https://64.media.tumblr.com/b_640.jpg", "width": 640, "height": 480}]},
+			{"type": "video", "media": {"url": "https://va.media.tumblr.com/c.mp4"}}
+		]
+	}`
+	if err := json.Unmarshal([]byte(body), &post); err != nil {
+		t.Fatal(err)
+	}
+
+	photos := post.Images()
+	if len(photos) != 2 {
+		t.Fatalf("Images() = %+v, want 2 photos", photos)
+	}
+	// reblogged image comes first.
+	if o := photos[0].OriginalSize; o == nil || o.Url != "https://64.media.tumblr.com/a_1280.jpg" {
+		t.Errorf("original size is %+v", o)
+	}
+	for i, want := range []string{"https://64.media.tumblr.com/a_1280.jpg", "https://64.media.tumblr.com/b_640.jpg"} {
+		size, ok := photos[i].SelectSize("largest")
+		if !ok || size.Url != want {
+			t.Errorf("largest of photo %d is %+v, want %s", i, size, want)
+		}
+	}
+}
+
+func TestImagesOfLegacyPost(t *testing.T) {
+	var post TumblrResponsePost
+	// trail of legacy response is html.
+	body := `{
+		"id": 100,
+		"type": "photo",
+		"photos": [{"alt_sizes": [{"url": "https://64.media.tumblr.com/a_1280.jpg", "width": 1280, "height": 960}]}],
+		"trail": [{"content": "<p>caption</p>"}]
+	}`
+	if err := json.Unmarshal([]byte(body), &post); err != nil {
+		t.Fatal(err)
+	}
+	if photos := post.Images(); len(photos) != 1 || photos[0].AltSizes[0].Url != "https://64.media.tumblr.com/a_1280.jpg" {
+		t.Errorf("Images() = %+v", photos)
+	}
+}